@@ -2,105 +2,181 @@ package main
 
 import (
 	"Rhodus/src"
-	"bufio"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
-	"strings"
 )
 
+// exit codes, a diagnostic returns the code of the phase that reported it
+const (
+	exitOK           = 0
+	exitUsage        = 1 // bad command line or file not found
+	exitScanError    = 2
+	exitSyntaxError  = 3
+	exitCompileError = 4
+	exitRuntimeError = 5
+)
+
+const usage = `Usage:
+  rhodus run [file.rh | -] [args]   run a script, - or no file reads it from stdin
+  rhodus file.rh [args]             same as run, used by #!/usr/bin/env rhodus scripts
+  rhodus repl                       start the interactive interpreter
+  rhodus check [file.rh | -]        report syntax and compile errors without running
+  rhodus tokens [file.rh | -]       print the tokens of a script
+  rhodus version                    print the Rhodus version
+`
+
 func main() {
-	fileName := `c:\a1\test.txt`
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		fmt.Println("File not found")
-		os.Exit(1)
+	os.Exit(runMain(os.Args[1:]))
+}
+
+func runMain(args []string) int {
+	if len(args) == 0 {
+		src.NewRepl().Start()
+		return exitOK
 	}
-	fileContent, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		panic(err)
+	switch args[0] {
+	case "run":
+		return runScript(args[1:])
+	case "repl":
+		src.NewRepl().Start()
+		return exitOK
+	case "check":
+		return checkScript(args[1:])
+	case "tokens":
+		return printTokens(args[1:])
+	case "version", "-v", "--version":
+		fmt.Printf("Rhodus version %s\n", src.RHODUS_VERSION)
+		return exitOK
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return exitOK
 	}
-	printContent(string(fileContent))
-
-	//repl := src.NewRepl()
-	//repl.Start("debug")
-	//src.Repl()
-	//testCalculator()
-	//testScannerWithRepl()
-	//testScannerWithFileName()
-	//fmt.Println(src.GetSampleScriptsDir())
+	if _, err := os.Stat(args[0]); err == nil {
+		return runScript(args)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command or file: %s\n%s", args[0], usage)
+	return exitUsage
 }
 
-func printContent(content string) {
-	r := bufio.NewReader(strings.NewReader(content))
-	for {
-		if chr, _, err := r.ReadRune(); err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				panic(err)
-			}
-		} else {
-			fmt.Printf("%q\n", chr)
+// readScript returns the contents and the name of the script given in
+// args, the standard input is read when there is no file name or it is "-"
+func readScript(args []string) (string, string, bool) {
+	if len(args) == 0 || args[0] == "-" {
+		content, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return "", "", false
 		}
+		return string(content), "<stdin>", true
+	}
+	content, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read the file: %s\n", args[0])
+		return "", "", false
 	}
+	return string(content), args[0], true
 }
 
-func testScannerWithFileName() {
-	fileName := `c:\a1\test1.rh`
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		fmt.Printf("file does not exist: %s\n", fileName)
-		return
+// exitCode maps an error to the exit code of the phase that reported it
+func exitCode(err error) int {
+	var diagnostic *src.Diagnostic
+	switch err := err.(type) {
+	case nil:
+		return exitOK
+	case *src.Diagnostic:
+		diagnostic = err
+	case src.DiagnosticList:
+		diagnostic = err[0]
+	default:
+		return exitUsage
 	}
-	fmt.Printf("Lexical analysis of file: %s\n", fileName)
-	fmt.Println("Test file contents:")
-	fmt.Println("-------------------------------")
-
-	fileContents, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		fmt.Printf("fatal error: could not open the file: %s", fileName)
+	switch diagnostic.Code / 100 {
+	case 1:
+		if diagnostic.Code == src.ErrFileNotFound {
+			return exitUsage
+		}
+		return exitScanError
+	case 2:
+		return exitSyntaxError
+	case 3:
+		return exitCompileError
 	}
+	return exitRuntimeError
+}
 
-	fmt.Println(string(fileContents))
-	fmt.Println("-------------------------------")
+// runScript runs a script, the arguments that follow the script name are
+// available to it as argc and argv(i)
+func runScript(args []string) int {
+	code, fileName, ok := readScript(args)
+	if !ok {
+		return exitUsage
+	}
+	var scriptArgs []string
+	if len(args) > 1 {
+		scriptArgs = args[1:]
+	}
+	in := src.NewInterpreter()
+	in.SetGlobal("argc", len(scriptArgs))
+	in.RegisterFunction("argv", func(i int) (string, error) {
+		if i < 0 || i >= len(scriptArgs) {
+			return "", fmt.Errorf("argv index %d out of range, argc is %d", i, len(scriptArgs))
+		}
+		return scriptArgs[i], nil
+	})
+	if fileName == "<stdin>" {
+		return exitCode(in.EvalString(code))
+	}
+	return exitCode(in.EvalFile(fileName))
+}
 
+// checkScript scans, parses and compiles a script without running it
+func checkScript(args []string) int {
+	code, fileName, ok := readScript(args)
+	if !ok {
+		return exitUsage
+	}
 	sc := src.NewScanner()
-	sc.ScanString(string(fileContents))
-	sy := src.NewSyntaxAnalisis(sc)
-	sy.Program()
-
-	// sc.NextToken()
-	// for sc.Token() != src.T_EOF {
-	// 	fmt.Println(sc.TokenToString(sc.Token()))
-	// 	sc.NextToken()
-	// }
-	fmt.Println("\n Success!")
+	sc.ScanString(code)
+	sc.FileName = fileName
+	err := sc.NextToken()
+	if err == nil {
+		var program *src.TASTProgram
+		program, err = src.NewSyntaxAnalisis(sc).Program()
+		if err == nil {
+			module := src.NewModule()
+			module.Name = fileName
+			err = src.NewCompiler(module).Compile(program)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+	fmt.Printf("%s: no errors found\n", fileName)
+	return exitOK
 }
 
-func testScannerWithRepl() {
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("Rhodus Scanner Test\nPlease type any valid command and hit enter.\n")
+// printTokens writes one line per token with its position
+func printTokens(args []string) int {
+	code, fileName, ok := readScript(args)
+	if !ok {
+		return exitUsage
+	}
+	sc := src.NewScanner()
+	sc.ScanString(code)
+	sc.FileName = fileName
+	result := exitOK
 	for {
-		fmt.Print(">> ")
-		scanned := scanner.Scan()
-		if !scanned {
-			return
+		if err := sc.NextToken(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			result = exitScanError
+			continue
 		}
-		input := scanner.Text()
-		sc := src.NewScanner()
-		sc.ScanString(input)
-		sc.NextToken()
-		for sc.Token() != src.T_EOF {
-			fmt.Println(sc.TokenToString(sc.Token()))
-			sc.NextToken()
+		if sc.Token() == src.T_EOF {
+			break
 		}
+		fmt.Printf("%d:%d\t%s\n", sc.TokenRecord.LineNumber, sc.TokenRecord.ColumnNumber, sc.TokenToString(sc.Token()))
 	}
-}
-
-func testCalculator() {
-	input := `a`
-	sc := src.NewScanner()
-	sc.ScanString(input)
-	sy := src.NewSyntaxAnalisisCalc(sc)
-	sy.Statement()
+	return result
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rhodus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		command string
+		script  string
+		code    int
+	}{
+		{"run", `x = 1`, exitOK},
+		{"run", `x = @`, exitScanError},
+		{"run", `x = `, exitSyntaxError},
+		{"run", `break`, exitCompileError},
+		{"run", `x = 1 div 0`, exitRuntimeError},
+		{"check", `x = 1 div 0`, exitOK},
+		{"check", `x = @`, exitScanError},
+		{"check", `x = `, exitSyntaxError},
+		{"check", `break`, exitCompileError},
+		{"tokens", `x = 1`, exitOK},
+		{"tokens", `x = @`, exitScanError},
+	}
+	for i, test := range tests {
+		file := filepath.Join(dir, "script.rh")
+		if err := ioutil.WriteFile(file, []byte(test.script), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if code := runMain([]string{test.command, file}); code != test.code {
+			t.Errorf("%d: rhodus %s %q exits with %d, expecting %d", i, test.command, test.script, code, test.code)
+		}
+	}
+	for _, args := range [][]string{{"run", filepath.Join(dir, "missing.rh")}, {"nosuchcommand"}} {
+		if code := runMain(args); code != exitUsage {
+			t.Errorf("rhodus %v exits with %d, expecting %d", args, code, exitUsage)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package src
+
+// TSourcePosition is the line and column where a node starts in the source code.
+type TSourcePosition struct {
+	Line   int
+	Column int
+}
+
+func (p TSourcePosition) Position() TSourcePosition {
+	return p
+}
+
+type TNode interface {
+	Position() TSourcePosition
+}
+
+type TStatement interface {
+	TNode
+	statementNode()
+}
+
+type TExpression interface {
+	TNode
+	expressionNode()
+}
+
+// TASTProgram is the root of the tree returned by SyntaxAnalisis.Program
+type TASTProgram struct {
+	TSourcePosition
+	Statements []TStatement
+}
+
+// statements
+
+// TAssignment ::= Target '=' Value, Target is a TIdentifier or a TIndexExpression
+type TAssignment struct {
+	TSourcePosition
+	Target TExpression
+	Value  TExpression
+}
+
+// TMultipleAssignment ::= Target {',' Target} '=' Value {',' Value}, all the
+// values are evaluated before the first target is assigned. A single Value
+// is a list unpacked into the targets
+type TMultipleAssignment struct {
+	TSourcePosition
+	Targets []TExpression
+	Values  []TExpression
+}
+
+// TExpressionStatement is an expression evaluated for its side effects, ie: a function call
+type TExpressionStatement struct {
+	TSourcePosition
+	Expression TExpression
+}
+
+type TIfStatement struct {
+	TSourcePosition
+	Condition TExpression
+	Then      []TStatement
+	Else      []TStatement
+}
+
+type TWhileStatement struct {
+	TSourcePosition
+	Condition TExpression
+	Body      []TStatement
+}
+
+type TRepeatStatement struct {
+	TSourcePosition
+	Body      []TStatement
+	Condition TExpression
+}
+
+type TForStatement struct {
+	TSourcePosition
+	Variable string
+	Start    TExpression
+	Stop     TExpression
+	Step     TExpression // nil when the loop has no step clause
+	Downto   bool
+	Body     []TStatement
+}
+
+// TForInStatement ::= 'for' Variable 'in' Collection 'do' Body 'end', a
+// range a..b is parsed into a TForStatement
+type TForInStatement struct {
+	TSourcePosition
+	Variable   string
+	Collection TExpression
+	Body       []TStatement
+}
+
+// TSwitchStatement runs the body of the first case with a label equal to
+// Subject, or Else when no label matches
+type TSwitchStatement struct {
+	TSourcePosition
+	Subject TExpression
+	Cases   []*TCaseClause
+	Else    []TStatement
+}
+
+type TCaseClause struct {
+	TSourcePosition
+	Labels []*TCaseLabel
+	Body   []TStatement
+}
+
+// TCaseLabel is a value, or the range Low..High when High is not nil
+type TCaseLabel struct {
+	TSourcePosition
+	Low  TExpression
+	High TExpression
+}
+
+type TBreakStatement struct {
+	TSourcePosition
+}
+
+type TContinueStatement struct {
+	TSourcePosition
+}
+
+// TGlobalStatement makes the names refer to module level variables in the
+// whole function where it appears
+type TGlobalStatement struct {
+	TSourcePosition
+	Names []string
+}
+
+// TReturnStatement has no Values when nothing follows the 'return' keyword
+type TReturnStatement struct {
+	TSourcePosition
+	Values []TExpression
+}
+
+// TParameter ::= ['ref'] Name ['=' Default] | '*' Name, a variadic
+// parameter is the last one and receives a list with the extra arguments
+type TParameter struct {
+	TSourcePosition
+	Name       string
+	IsRef      bool
+	Default    TExpression // nil when the parameter has no default value
+	IsVariadic bool
+}
+
+type TFunctionDef struct {
+	TSourcePosition
+	Name       string
+	Parameters []TParameter
+	Body       []TStatement
+}
+
+type TPrintStatement struct {
+	TSourcePosition
+	NewLine   bool
+	Arguments []TExpression
+}
+
+// expressions
+
+type TIntegerLiteral struct {
+	TSourcePosition
+	Value int
+}
+
+type TFloatLiteral struct {
+	TSourcePosition
+	Value float64
+}
+
+type TStringLiteral struct {
+	TSourcePosition
+	Value string
+}
+
+type TBooleanLiteral struct {
+	TSourcePosition
+	Value bool
+}
+
+type TListLiteral struct {
+	TSourcePosition
+	Elements []TExpression
+}
+
+// TMapLiteral holds the keys and values in source order, {:} is the empty map
+type TMapLiteral struct {
+	TSourcePosition
+	Keys   []TExpression
+	Values []TExpression
+}
+
+type TIdentifier struct {
+	TSourcePosition
+	Name string
+}
+
+// TIndexExpression ::= Target '[' Indices ']'
+type TIndexExpression struct {
+	TSourcePosition
+	Target  TExpression
+	Indices []TExpression
+}
+
+// TSliceExpression ::= [Low] ':' [High], only found in the indices of a TIndexExpression
+type TSliceExpression struct {
+	TSourcePosition
+	Low  TExpression // nil from the start
+	High TExpression // nil to the end
+}
+
+// TCallExpression ::= Function '(' Arguments ')', the last len(Names)
+// arguments are given by name
+type TCallExpression struct {
+	TSourcePosition
+	Function  TExpression
+	Arguments []TExpression
+	Names     []string
+}
+
+// TBinaryExpression holds arithmetic, relational and logical operators, the
+// operator is the token code that was scanned: T_PLUS, T_LESS, T_AND, etc.
+type TBinaryExpression struct {
+	TSourcePosition
+	Operator TokenCode
+	Left     TExpression
+	Right    TExpression
+}
+
+// TUnaryExpression holds unary minus (T_MINUS) and logical negation (T_NOT)
+type TUnaryExpression struct {
+	TSourcePosition
+	Operator TokenCode
+	Operand  TExpression
+}
+
+// TFunctionExpression ::= 'function' '(' Parameters ')' Body 'end', an
+// anonymous function that can use the local variables of the enclosing functions
+type TFunctionExpression struct {
+	TSourcePosition
+	Parameters []TParameter
+	Body       []TStatement
+}
+
+func (*TAssignment) statementNode()          {}
+func (*TMultipleAssignment) statementNode()  {}
+func (*TExpressionStatement) statementNode() {}
+func (*TIfStatement) statementNode()         {}
+func (*TWhileStatement) statementNode()      {}
+func (*TRepeatStatement) statementNode()     {}
+func (*TForStatement) statementNode()        {}
+func (*TForInStatement) statementNode()      {}
+func (*TSwitchStatement) statementNode()     {}
+func (*TBreakStatement) statementNode()      {}
+func (*TContinueStatement) statementNode()   {}
+func (*TReturnStatement) statementNode()     {}
+func (*TGlobalStatement) statementNode()     {}
+func (*TFunctionDef) statementNode()         {}
+func (*TPrintStatement) statementNode()      {}
+
+func (*TIntegerLiteral) expressionNode()     {}
+func (*TFloatLiteral) expressionNode()       {}
+func (*TStringLiteral) expressionNode()      {}
+func (*TBooleanLiteral) expressionNode()     {}
+func (*TListLiteral) expressionNode()        {}
+func (*TMapLiteral) expressionNode()         {}
+func (*TIdentifier) expressionNode()         {}
+func (*TIndexExpression) expressionNode()    {}
+func (*TSliceExpression) expressionNode()    {}
+func (*TCallExpression) expressionNode()     {}
+func (*TFunctionExpression) expressionNode() {}
+func (*TBinaryExpression) expressionNode()   {}
+func (*TUnaryExpression) expressionNode()    {}
+
+// inspect calls visit for every node of statements in depth-first order, the
+// children of a node are skipped when visit returns false
+func inspect(statements []TStatement, visit func(node TNode) bool) {
+	for _, statement := range statements {
+		inspectNode(statement, visit)
+	}
+}
+
+func inspectNode(node TNode, visit func(node TNode) bool) {
+	if node == nil || !visit(node) {
+		return
+	}
+	expressions := func(expressions ...TExpression) {
+		for _, expression := range expressions {
+			if expression != nil {
+				inspectNode(expression, visit)
+			}
+		}
+	}
+	switch node := node.(type) {
+	case *TAssignment:
+		expressions(node.Target, node.Value)
+	case *TMultipleAssignment:
+		expressions(node.Targets...)
+		expressions(node.Values...)
+	case *TExpressionStatement:
+		expressions(node.Expression)
+	case *TIfStatement:
+		expressions(node.Condition)
+		inspect(node.Then, visit)
+		inspect(node.Else, visit)
+	case *TWhileStatement:
+		expressions(node.Condition)
+		inspect(node.Body, visit)
+	case *TRepeatStatement:
+		inspect(node.Body, visit)
+		expressions(node.Condition)
+	case *TForStatement:
+		expressions(node.Start, node.Stop, node.Step)
+		inspect(node.Body, visit)
+	case *TForInStatement:
+		expressions(node.Collection)
+		inspect(node.Body, visit)
+	case *TSwitchStatement:
+		expressions(node.Subject)
+		for _, clause := range node.Cases {
+			for _, label := range clause.Labels {
+				expressions(label.Low, label.High)
+			}
+			inspect(clause.Body, visit)
+		}
+		inspect(node.Else, visit)
+	case *TReturnStatement:
+		expressions(node.Values...)
+	case *TFunctionDef:
+		inspectDefaults(node.Parameters, visit)
+		inspect(node.Body, visit)
+	case *TPrintStatement:
+		expressions(node.Arguments...)
+	case *TListLiteral:
+		expressions(node.Elements...)
+	case *TMapLiteral:
+		expressions(node.Keys...)
+		expressions(node.Values...)
+	case *TIndexExpression:
+		expressions(node.Target)
+		expressions(node.Indices...)
+	case *TSliceExpression:
+		expressions(node.Low, node.High)
+	case *TCallExpression:
+		expressions(node.Function)
+		expressions(node.Arguments...)
+	case *TBinaryExpression:
+		expressions(node.Left, node.Right)
+	case *TUnaryExpression:
+		expressions(node.Operand)
+	case *TFunctionExpression:
+		inspectDefaults(node.Parameters, visit)
+		inspect(node.Body, visit)
+	}
+}
+
+func inspectDefaults(parameters []TParameter, visit func(node TNode) bool) {
+	for _, parameter := range parameters {
+		if parameter.Default != nil {
+			inspectNode(parameter.Default, visit)
+		}
+	}
+}
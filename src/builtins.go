@@ -0,0 +1,313 @@
+package src
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"unicode/utf8"
+)
+
+// TBuiltinFunction is a Go function callable from Rhodus. The arguments are
+// converted to the types of the Go function parameters: any integer or
+// floating point kind (an integer argument is promoted to a float), bool,
+// string, interface{} or TMachineStackRecord. The Go function may return
+// nothing, a value, or a value and an error.
+type TBuiltinFunction struct {
+	Name     string
+	function reflect.Value
+	arity    int // number of fixed parameters
+	variadic bool
+}
+
+var (
+	recordType = reflect.TypeOf(TMachineStackRecord{})
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+func newBuiltinFunction(name string, function interface{}) (*TBuiltinFunction, error) {
+	value := reflect.ValueOf(function)
+	if value.Kind() != reflect.Func {
+		return nil, fmt.Errorf("builtin '%s' must be a function, found %T", name, function)
+	}
+	functionType := value.Type()
+	if functionType.NumOut() > 2 || (functionType.NumOut() == 2 && functionType.Out(1) != errorType) {
+		return nil, fmt.Errorf("builtin '%s' must return nothing, a value, or a value and an error", name)
+	}
+	for i := 0; i < functionType.NumIn(); i++ {
+		parameterType := functionType.In(i)
+		if functionType.IsVariadic() && i == functionType.NumIn()-1 {
+			parameterType = parameterType.Elem()
+		}
+		if !supportedParameter(parameterType) {
+			return nil, fmt.Errorf("parameter %d of builtin '%s' has the unsupported type %s", i+1, name, parameterType)
+		}
+	}
+	if functionType.NumOut() > 0 && !supportedResult(functionType.Out(0)) {
+		return nil, fmt.Errorf("builtin '%s' returns the unsupported type %s", name, functionType.Out(0))
+	}
+	builtin := &TBuiltinFunction{
+		Name:     name,
+		function: value,
+		arity:    functionType.NumIn(),
+		variadic: functionType.IsVariadic(),
+	}
+	if builtin.variadic {
+		builtin.arity -= 1
+	}
+	return builtin, nil
+}
+
+func (b *TBuiltinFunction) checkArity(count int) error {
+	if count == b.arity || (b.variadic && count > b.arity) {
+		return nil
+	}
+	if b.variadic {
+		return fmt.Errorf("function '%s' expects at least %d arguments, found %d", b.Name, b.arity, count)
+	}
+	return fmt.Errorf("function '%s' expects %d arguments, found %d", b.Name, b.arity, count)
+}
+
+// call converts the arguments, calls the Go function and converts its result.
+// A panic of the Go function becomes an error, it must not stop the host.
+func (b *TBuiltinFunction) call(args []TMachineStackRecord) (result TMachineStackRecord, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("function '%s' failed: %v", b.Name, r)
+		}
+	}()
+	if err := b.checkArity(len(args)); err != nil {
+		return TMachineStackRecord{}, err
+	}
+	functionType := b.function.Type()
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var parameterType reflect.Type
+		if b.variadic && i >= b.arity {
+			parameterType = functionType.In(b.arity).Elem()
+		} else {
+			parameterType = functionType.In(i)
+		}
+		value, err := fromMachineStackRecord(arg, parameterType)
+		if err != nil {
+			return TMachineStackRecord{}, fmt.Errorf("argument %d of function '%s': %s", i+1, b.Name, err)
+		}
+		in[i] = value
+	}
+	out := b.function.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return TMachineStackRecord{}, out[1].Interface().(error)
+	}
+	if len(out) == 0 || (out[0].Kind() == reflect.Interface && out[0].IsNil()) {
+		return TMachineStackRecord{stackType: stNone}, nil
+	}
+	result, err = toMachineStackRecord(out[0].Interface())
+	if err != nil {
+		return TMachineStackRecord{}, fmt.Errorf("function '%s' returned %T, which is not a Rhodus value", b.Name, out[0].Interface())
+	}
+	return result, nil
+}
+
+func isIntKind(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Int64
+}
+
+func isUintKind(kind reflect.Kind) bool {
+	return kind >= reflect.Uint && kind <= reflect.Uintptr
+}
+
+func isFloatKind(kind reflect.Kind) bool {
+	return kind == reflect.Float32 || kind == reflect.Float64
+}
+
+// supportedParameter reports if fromMachineStackRecord can convert a Rhodus
+// value to goType
+func supportedParameter(goType reflect.Type) bool {
+	kind := goType.Kind()
+	return goType == recordType || (kind == reflect.Interface && goType.NumMethod() == 0) ||
+		isIntKind(kind) || isUintKind(kind) || isFloatKind(kind) || kind == reflect.Bool || kind == reflect.String
+}
+
+// supportedResult reports if toMachineStackRecord can convert a value of
+// goType, an interface is checked when the function returns
+func supportedResult(goType reflect.Type) bool {
+	kind := goType.Kind()
+	return goType == recordType || kind == reflect.Interface || isIntKind(kind) || isUintKind(kind) || isFloatKind(kind) ||
+		kind == reflect.Bool || kind == reflect.String ||
+		goType == reflect.TypeOf([]interface{}{}) || goType == reflect.TypeOf(map[string]interface{}{})
+}
+
+// fromMachineStackRecord converts a Rhodus value to the Go type expected by a builtin
+func fromMachineStackRecord(value TMachineStackRecord, goType reflect.Type) (reflect.Value, error) {
+	switch {
+	case goType == recordType:
+		return reflect.ValueOf(value), nil
+	case goType.Kind() == reflect.Interface:
+		if value.stackType == stNone {
+			return reflect.Zero(goType), nil
+		}
+		return reflect.ValueOf(value.toGoValue()), nil
+	case isIntKind(goType.Kind()) && value.stackType == stInteger:
+		if reflect.Zero(goType).OverflowInt(int64(value.iValue)) {
+			return reflect.Value{}, fmt.Errorf("%d does not fit in %s", value.iValue, goType)
+		}
+		return reflect.ValueOf(value.iValue).Convert(goType), nil
+	case isUintKind(goType.Kind()) && value.stackType == stInteger:
+		if value.iValue < 0 || reflect.Zero(goType).OverflowUint(uint64(value.iValue)) {
+			return reflect.Value{}, fmt.Errorf("%d does not fit in %s", value.iValue, goType)
+		}
+		return reflect.ValueOf(value.iValue).Convert(goType), nil
+	case isFloatKind(goType.Kind()) && isNumber(value):
+		return reflect.ValueOf(toDouble(value)).Convert(goType), nil
+	case goType.Kind() == reflect.Bool && value.stackType == stBoolean:
+		return reflect.ValueOf(value.bValue).Convert(goType), nil
+	case goType.Kind() == reflect.String && value.stackType == stString:
+		return reflect.ValueOf(value.sValue).Convert(goType), nil
+	}
+	return reflect.Value{}, fmt.Errorf("expecting %s, found %s", goType, value.typeName())
+}
+
+// registerBuiltin stores the builtin in the global variable with its name
+func (m *Module) registerBuiltin(builtin *TBuiltinFunction) {
+	m.globals[m.lookupGlobal(builtin.Name)].Value = TMachineStackRecord{stackType: stBuiltin, lValue: builtin}
+}
+
+// registerStandardBuiltins adds the functions available to every Rhodus program
+func registerStandardBuiltins(m *Module) {
+	standard := map[string]interface{}{
+		"min":      builtinMin,
+		"max":      builtinMax,
+		"abs":      builtinAbs,
+		"len":      builtinLen,
+		"keys":     builtinKeys,
+		"remove":   builtinRemove,
+		"zeros":    builtinZeros,
+		"identity": builtinIdentity,
+		"toMatrix": builtinMatrix,
+		"size":     builtinSize,
+		"sqrt":     math.Sqrt,
+	}
+	for name, function := range standard {
+		builtin, _ := newBuiltinFunction(name, function)
+		m.registerBuiltin(builtin)
+	}
+}
+
+// minMax returns the smallest (sign -1) or largest (sign 1) of the numbers,
+// the result is an integer when all of them are integers
+func minMax(name string, sign float64, values []TMachineStackRecord) (TMachineStackRecord, error) {
+	if len(values) == 0 {
+		return TMachineStackRecord{}, fmt.Errorf("function '%s' expects at least 1 argument", name)
+	}
+	result := values[0]
+	for _, value := range values {
+		if !isNumber(value) {
+			return TMachineStackRecord{}, fmt.Errorf("function '%s' expects numbers, found %s", name, value.typeName())
+		}
+		if sign*(toDouble(value)-toDouble(result)) > 0 {
+			result = value
+		}
+	}
+	for _, value := range values {
+		if value.stackType == stDouble {
+			return TMachineStackRecord{stackType: stDouble, dValue: toDouble(result)}, nil
+		}
+	}
+	return result, nil
+}
+
+func builtinMin(values ...TMachineStackRecord) (TMachineStackRecord, error) {
+	return minMax("min", -1, values)
+}
+
+func builtinMax(values ...TMachineStackRecord) (TMachineStackRecord, error) {
+	return minMax("max", 1, values)
+}
+
+func builtinAbs(value TMachineStackRecord) (TMachineStackRecord, error) {
+	switch value.stackType {
+	case stInteger:
+		if value.iValue < 0 {
+			value.iValue = -value.iValue
+		}
+		return value, nil
+	case stDouble:
+		value.dValue = math.Abs(value.dValue)
+		return value, nil
+	}
+	return TMachineStackRecord{}, fmt.Errorf("function 'abs' expects a number, found %s", value.typeName())
+}
+
+func builtinLen(value TMachineStackRecord) (int, error) {
+	switch value.stackType {
+	case stList:
+		return len(value.lValue.(*TListObject).elements), nil
+	case stString:
+		return utf8.RuneCountInString(value.sValue), nil // the characters visited by for-in
+	case stMatrix:
+		return value.lValue.(*TMatrixObject).rows, nil
+	case stMap:
+		return len(value.lValue.(*TMapObject).entries), nil
+	}
+	return 0, fmt.Errorf("function 'len' expects a list, a map, a string or a matrix, found %s", value.typeName())
+}
+
+func builtinZeros(rows, cols int) (TMachineStackRecord, error) {
+	if rows < 0 || cols < 0 {
+		return TMachineStackRecord{}, fmt.Errorf("function 'zeros' expects non negative dimensions, found %d, %d", rows, cols)
+	}
+	if err := checkMatrixSize(rows, cols); err != nil {
+		return TMachineStackRecord{}, err
+	}
+	return newMatrixValue(newMatrix(rows, cols)), nil
+}
+
+func builtinIdentity(n int) (TMachineStackRecord, error) {
+	if n < 0 {
+		return TMachineStackRecord{}, fmt.Errorf("function 'identity' expects a non negative size, found %d", n)
+	}
+	if err := checkMatrixSize(n, n); err != nil {
+		return TMachineStackRecord{}, err
+	}
+	return newMatrixValue(identityMatrix(n)), nil
+}
+
+// builtinMatrix converts a list of rows into a matrix, toMatrix({{1, 2}, {3, 4}})
+func builtinMatrix(value TMachineStackRecord) (TMachineStackRecord, error) {
+	switch value.stackType {
+	case stList:
+		m, err := matrixFromList(value.lValue.(*TListObject))
+		if err != nil {
+			return TMachineStackRecord{}, err
+		}
+		return newMatrixValue(m), nil
+	case stMatrix:
+		m := value.lValue.(*TMatrixObject)
+		return newMatrixValue(m.subMatrix(0, m.rows, 0, m.cols)), nil
+	}
+	return TMachineStackRecord{}, fmt.Errorf("function 'toMatrix' expects a list of rows, found %s", value.typeName())
+}
+
+// builtinSize returns the list {rows, columns} of a matrix
+func builtinSize(value TMachineStackRecord) (TMachineStackRecord, error) {
+	if value.stackType != stMatrix {
+		return TMachineStackRecord{}, fmt.Errorf("function 'size' expects a matrix, found %s", value.typeName())
+	}
+	m := value.lValue.(*TMatrixObject)
+	return newListValue([]TMachineStackRecord{{stackType: stInteger, iValue: m.rows}, {stackType: stInteger, iValue: m.cols}}), nil
+}
+
+// builtinKeys returns the keys of a map in the order they were added
+func builtinKeys(value TMachineStackRecord) (TMachineStackRecord, error) {
+	if value.stackType != stMap {
+		return TMachineStackRecord{}, fmt.Errorf("function 'keys' expects a map, found %s", value.typeName())
+	}
+	return newListValue(value.lValue.(*TMapObject).keys()), nil
+}
+
+// builtinRemove deletes a key from a map, it returns False if the key was missing
+func builtinRemove(value TMachineStackRecord, key TMachineStackRecord) (bool, error) {
+	if value.stackType != stMap {
+		return false, fmt.Errorf("function 'remove' expects a map, found %s", value.typeName())
+	}
+	return value.lValue.(*TMapObject).remove(key)
+}
@@ -1,8 +1,49 @@
 package src
 
+import "math"
+
 type TByteCode struct {
 	OpCode OpCode
 	index  int
+	line   int
 }
 
 type TProgram []TByteCode
+
+// TJumpTable maps the integers low, low+1, ... to the instruction of the
+// case that handles them, any other value jumps to otherwise
+type TJumpTable struct {
+	low       int
+	targets   []int
+	labels    []int // label that has every integer, -1 for none
+	otherwise int
+}
+
+// target returns the instruction for value. A double between two integers
+// is handled by their case when both come from the same range label.
+func (t *TJumpTable) target(value TMachineStackRecord) int {
+	switch value.stackType {
+	case stInteger:
+		return t.entry(value.iValue)
+	case stDouble:
+		if math.IsNaN(value.dValue) || math.Abs(value.dValue) >= 1<<53 {
+			return t.otherwise
+		}
+		below := math.Floor(value.dValue)
+		if below == value.dValue {
+			return t.entry(int(below))
+		}
+		i := int(below) - t.low
+		if i >= 0 && i+1 < len(t.labels) && t.labels[i] >= 0 && t.labels[i] == t.labels[i+1] {
+			return t.targets[i]
+		}
+	}
+	return t.otherwise
+}
+
+func (t *TJumpTable) entry(i int) int {
+	if i < t.low || i > t.low+len(t.targets)-1 {
+		return t.otherwise
+	}
+	return t.targets[i-t.low]
+}
@@ -0,0 +1,1193 @@
+package src
+
+import "sort"
+
+// TCompilerScope holds the code being generated for the module level
+// program or for the body of a function
+type TCompilerScope struct {
+	function   *TFunctionObject // nil at module level
+	enclosing  *TCompilerScope  // scope of the code that defines the function
+	locals     map[string]int
+	references map[string]bool             // ref parameters and captured locals, their slot holds a reference
+	globals    map[string]bool             // names declared global in the function
+	functions  map[string]*TFunctionObject // functions defined in the function, by name
+	upvalues   []TUpvalue                  // variables of the enclosing functions used by the function
+	loops      []*TLoop                    // loops being compiled, the innermost is the last
+	code       TProgram
+}
+
+// TUpvalue is a variable of an enclosing function captured by a closure,
+// index is a local slot of the enclosing function when isLocal is true,
+// otherwise an upvalue of the enclosing function
+type TUpvalue struct {
+	name    string
+	isLocal bool
+	index   int
+}
+
+// TLoop holds the jumps of the break and continue statements of a loop,
+// they are patched when the code of the whole loop has been generated
+type TLoop struct {
+	breaks    []int
+	continues []int
+}
+
+type Compiler struct {
+	module *Module
+	scope  *TCompilerScope
+}
+
+func NewCompiler(module *Module) *Compiler {
+	c := &Compiler{
+		module: module,
+	}
+	return c
+}
+
+// Compile translates program into byte code and stores it in the module,
+// semantic errors are returned as a *Diagnostic
+func (c *Compiler) Compile(program *TASTProgram) (err error) {
+	defer recoverDiagnostic(&err)
+	c.scope = &TCompilerScope{}
+	c.collectAssigned(program.Statements)
+	c.declareFunctions(program.Statements)
+	c.statementList(program.Statements)
+	c.emit(oHalt, 0, program.Position())
+	c.module.Code = c.scope.code
+	return nil
+}
+
+func (c *Compiler) emit(opCode OpCode, index int, pos TSourcePosition) int {
+	c.scope.code = append(c.scope.code, TByteCode{OpCode: opCode, index: index, line: pos.Line})
+	return len(c.scope.code) - 1
+}
+
+// emitJump emits a jump with an unknown target, the target is set with patchJump
+func (c *Compiler) emitJump(opCode OpCode, pos TSourcePosition) int {
+	return c.emit(opCode, -1, pos)
+}
+
+// patchJump makes the jump at location point to the next instruction
+func (c *Compiler) patchJump(location int) {
+	c.scope.code[location].index = len(c.scope.code)
+}
+
+func (c *Compiler) currentLocation() int {
+	return len(c.scope.code)
+}
+
+func (c *Compiler) error(pos TSourcePosition, code ErrorCode, format string, args ...interface{}) {
+	diagnostic := newDiagnostic(code, pos.Line, pos.Column, format, args...)
+	diagnostic.File = c.module.Name
+	panic(diagnostic)
+}
+
+func (c *Compiler) statementList(statements []TStatement) {
+	for _, statement := range statements {
+		c.statement(statement)
+	}
+}
+
+func (c *Compiler) statement(statement TStatement) {
+	switch node := statement.(type) {
+	case *TAssignment:
+		c.assignment(node)
+	case *TMultipleAssignment:
+		c.multipleAssignment(node)
+	case *TExpressionStatement:
+		c.values(node.Expression)
+		c.emit(oPop, 0, node.Position())
+	case *TIfStatement:
+		c.ifStatement(node)
+	case *TWhileStatement:
+		c.whileStatement(node)
+	case *TRepeatStatement:
+		c.repeatStatement(node)
+	case *TForStatement:
+		c.forStatement(node)
+	case *TForInStatement:
+		c.forInStatement(node)
+	case *TSwitchStatement:
+		c.switchStatement(node)
+	case *TBreakStatement:
+		loop := c.innermostLoop(node.Position(), "break")
+		loop.breaks = append(loop.breaks, c.emitJump(oJmp, node.Position()))
+	case *TContinueStatement:
+		loop := c.innermostLoop(node.Position(), "continue")
+		loop.continues = append(loop.continues, c.emitJump(oJmp, node.Position()))
+	case *TReturnStatement:
+		c.returnStatement(node)
+	case *TGlobalStatement:
+		if c.scope.function == nil {
+			c.error(node.Position(), ErrCompile, "global can only be used inside a function")
+		}
+	case *TFunctionDef:
+		c.functionDef(node)
+	case *TPrintStatement:
+		for _, argument := range node.Arguments {
+			c.expression(argument)
+		}
+		if node.NewLine {
+			c.emit(oPrintln, len(node.Arguments), node.Position())
+		} else {
+			c.emit(oPrint, len(node.Arguments), node.Position())
+		}
+	default:
+		c.error(statement.Position(), ErrCompile, "unsupported statement")
+	}
+}
+
+// assignment: the container and the subscripts of an indexed target are
+// evaluated before the value
+func (c *Compiler) assignment(node *TAssignment) {
+	switch target := node.Target.(type) {
+	case *TIdentifier:
+		c.expression(node.Value)
+		c.storeVariable(target.Name, node.Position())
+	case *TIndexExpression:
+		c.indexedTarget(target)
+		c.expression(node.Value)
+		c.emit(oStoreIndexed, len(target.Indices), node.Position())
+	default:
+		c.error(node.Position(), ErrInvalidAssignment, "left-hand side of the assignment must be a variable")
+	}
+}
+
+// multipleAssignment pushes all the values, or the elements of a single list,
+// then assigns the targets from the first one, oRoll brings its value to the
+// top of the stack:
+//
+//	values; [oUnpack n]; { [container; subscripts]; oRoll depth; store }
+func (c *Compiler) multipleAssignment(node *TMultipleAssignment) {
+	count := len(node.Targets)
+	if len(node.Values) == 1 {
+		c.values(node.Values[0])
+		c.emit(oUnpack, count, node.Position())
+	} else if count == 1 {
+		c.error(node.Position(), ErrValueCount, "cannot assign %d values to a single variable, use a list", len(node.Values))
+	} else if len(node.Values) != count {
+		c.error(node.Position(), ErrValueCount, "cannot assign %d values to %d variables", len(node.Values), count)
+	} else {
+		for _, value := range node.Values {
+			c.expression(value)
+		}
+	}
+	for i, target := range node.Targets {
+		depth := count - 1 - i
+		switch target := target.(type) {
+		case *TIdentifier:
+			c.roll(depth, target.Position())
+			c.storeVariable(target.Name, target.Position())
+		case *TIndexExpression:
+			c.indexedTarget(target)
+			c.roll(depth+len(target.Indices)+1, target.Position())
+			c.emit(oStoreIndexed, len(target.Indices), target.Position())
+		default:
+			c.error(target.Position(), ErrInvalidAssignment, "left-hand side of the assignment must be a variable")
+		}
+	}
+}
+
+// indexedTarget pushes the container and the subscripts of an element that
+// is assigned
+func (c *Compiler) indexedTarget(target *TIndexExpression) {
+	if identifier, ok := target.Target.(*TIdentifier); ok {
+		// a reference lets the virtual machine create a matrix in an unassigned variable
+		c.variableReference(identifier.Name, target.Position())
+	} else {
+		c.expression(target.Target)
+	}
+	for _, index := range target.Indices {
+		c.expression(index)
+	}
+}
+
+func (c *Compiler) roll(depth int, pos TSourcePosition) {
+	if depth > 0 {
+		c.emit(oRoll, depth, pos)
+	}
+}
+
+// loadVariable, storeVariable and variableReference resolve name to a local
+// slot of the function being compiled, to a local of an enclosing function
+// through an upvalue, or else to a global variable
+func (c *Compiler) loadVariable(name string, pos TSourcePosition) {
+	if slot, ok := c.scope.locals[name]; ok && c.scope.references[name] {
+		c.emit(oLoadRef, slot, pos)
+	} else if ok {
+		c.emit(oLoadLocal, slot, pos)
+	} else if index, ok := c.resolveUpvalue(c.scope, name); ok {
+		c.emit(oLoadUpvalue, index, pos)
+	} else {
+		c.emit(oLoad, c.module.lookupGlobal(name), pos)
+	}
+}
+
+func (c *Compiler) storeVariable(name string, pos TSourcePosition) {
+	if slot, ok := c.scope.locals[name]; ok && c.scope.references[name] {
+		c.emit(oStoreRef, slot, pos)
+	} else if ok {
+		c.emit(oStoreLocal, slot, pos)
+	} else if index, ok := c.resolveUpvalue(c.scope, name); ok {
+		c.emit(oStoreUpvalue, index, pos)
+	} else {
+		c.emit(oStore, c.module.lookupGlobal(name), pos)
+	}
+}
+
+// resolveUpvalue returns the upvalue of scope for a local variable of one of
+// the enclosing functions, adding it the first time the variable is used
+func (c *Compiler) resolveUpvalue(scope *TCompilerScope, name string) (int, bool) {
+	enclosing := scope.enclosing
+	if scope.globals[name] || enclosing == nil || enclosing.function == nil {
+		return 0, false
+	}
+	if slot, ok := enclosing.locals[name]; ok {
+		return scope.addUpvalue(name, true, slot), true
+	}
+	if index, ok := c.resolveUpvalue(enclosing, name); ok {
+		return scope.addUpvalue(name, false, index), true
+	}
+	return 0, false
+}
+
+func (scope *TCompilerScope) addUpvalue(name string, isLocal bool, index int) int {
+	for i, upvalue := range scope.upvalues {
+		if upvalue.name == name {
+			return i
+		}
+	}
+	scope.upvalues = append(scope.upvalues, TUpvalue{name: name, isLocal: isLocal, index: index})
+	return len(scope.upvalues) - 1
+}
+
+// enclosingLocal reports if name is a local variable of a function that
+// encloses the one being compiled
+func (c *Compiler) enclosingLocal(name string) bool {
+	return c.enclosingScope(name) != nil
+}
+
+// enclosingScope returns the scope of the enclosing function that has a
+// local variable name, nil if name is global for the function being compiled
+func (c *Compiler) enclosingScope(name string) *TCompilerScope {
+	for scope := c.scope; scope.enclosing != nil && scope.enclosing.function != nil; scope = scope.enclosing {
+		if scope.globals[name] {
+			return nil
+		}
+		if _, ok := scope.enclosing.locals[name]; ok {
+			return scope.enclosing
+		}
+	}
+	return nil
+}
+
+func (c *Compiler) beginLoop() {
+	c.scope.loops = append(c.scope.loops, &TLoop{})
+}
+
+// endLoop makes the continue statements jump to continueTarget and the
+// break statements to the next instruction, which removes the values the
+// loop keeps on the stack
+func (c *Compiler) endLoop(continueTarget int) {
+	loop := c.scope.loops[len(c.scope.loops)-1]
+	c.scope.loops = c.scope.loops[:len(c.scope.loops)-1]
+	for _, location := range loop.continues {
+		c.scope.code[location].index = continueTarget
+	}
+	for _, location := range loop.breaks {
+		c.patchJump(location)
+	}
+}
+
+func (c *Compiler) innermostLoop(pos TSourcePosition, statement string) *TLoop {
+	if len(c.scope.loops) == 0 {
+		c.error(pos, ErrOutsideLoop, "%s can only be used inside a loop", statement)
+	}
+	return c.scope.loops[len(c.scope.loops)-1]
+}
+
+// ifStatement:
+//
+//	condition; oJmpIfFalse else; then; oJmp end; else: elseStatements; end:
+func (c *Compiler) ifStatement(node *TIfStatement) {
+	c.expression(node.Condition)
+	elseJump := c.emitJump(oJmpIfFalse, node.Position())
+	c.statementList(node.Then)
+	if len(node.Else) > 0 {
+		endJump := c.emitJump(oJmp, node.Position())
+		c.patchJump(elseJump)
+		c.statementList(node.Else)
+		c.patchJump(endJump)
+	} else {
+		c.patchJump(elseJump)
+	}
+}
+
+// whileStatement:
+//
+//	start: condition; oJmpIfFalse end; body; oJmp start; end:
+func (c *Compiler) whileStatement(node *TWhileStatement) {
+	c.beginLoop()
+	start := c.currentLocation()
+	c.expression(node.Condition)
+	exitJump := c.emitJump(oJmpIfFalse, node.Position())
+	c.statementList(node.Body)
+	c.emit(oJmp, start, node.Position())
+	c.patchJump(exitJump)
+	c.endLoop(start)
+}
+
+// repeatStatement, continue jumps to the condition:
+//
+//	start: body; condition; oJmpIfFalse start
+func (c *Compiler) repeatStatement(node *TRepeatStatement) {
+	c.beginLoop()
+	start := c.currentLocation()
+	c.statementList(node.Body)
+	condition := c.currentLocation()
+	c.expression(node.Condition)
+	c.emit(oJmpIfFalse, start, node.Position())
+	c.endLoop(condition)
+}
+
+// forStatement keeps the final value and the step on the stack while the
+// loop runs, downto subtracts the step, which cannot be negative. After the
+// loop the variable holds the first value that went past the final value,
+// continue jumps to next.
+//
+//	start; store i; stop; step; loop: load i; oForTest exit
+//	body; next: oDup; load i; oAdd; store i; oJmp loop; exit: oPop; oPop
+func (c *Compiler) forStatement(node *TForStatement) {
+	pos := node.Position()
+	c.expression(node.Start)
+	c.storeVariable(node.Variable, pos)
+	c.expression(node.Stop)
+	if node.Step == nil {
+		c.emit(oPushi, 1, pos)
+	} else {
+		if isZeroConstant(node.Step) {
+			c.error(node.Step.Position(), ErrCompile, "the step of a for loop cannot be zero")
+		} else if node.Downto && isNegativeConstant(node.Step) {
+			c.error(node.Step.Position(), ErrCompile, "the step of a downto loop cannot be negative")
+		}
+		c.expression(node.Step)
+	}
+	if node.Downto {
+		c.emit(oDowntoStep, 0, pos)
+	}
+	c.beginLoop()
+	loop := c.currentLocation()
+	c.loadVariable(node.Variable, pos)
+	exitJump := c.emitJump(oForTest, pos)
+	c.statementList(node.Body)
+	next := c.currentLocation()
+	c.emit(oDup, 0, pos)
+	c.loadVariable(node.Variable, pos)
+	c.emit(oAdd, 0, pos)
+	c.storeVariable(node.Variable, pos)
+	c.emit(oJmp, loop, pos)
+	c.patchJump(exitJump)
+	c.endLoop(next)
+	c.emit(oPop, 0, pos)
+	c.emit(oPop, 0, pos)
+}
+
+// isZeroConstant is true for the literals 0 and 0.0, with or without a sign
+func isZeroConstant(expression TExpression) bool {
+	switch node := expression.(type) {
+	case *TIntegerLiteral:
+		return node.Value == 0
+	case *TFloatLiteral:
+		return node.Value == 0
+	case *TUnaryExpression:
+		return node.Operator == T_MINUS && isZeroConstant(node.Operand)
+	}
+	return false
+}
+
+// isNegativeConstant is true for a minus sign before a non zero literal
+func isNegativeConstant(expression TExpression) bool {
+	node, ok := expression.(*TUnaryExpression)
+	if !ok || node.Operator != T_MINUS {
+		return false
+	}
+	switch operand := node.Operand.(type) {
+	case *TIntegerLiteral:
+		return operand.Value > 0
+	case *TFloatLiteral:
+		return operand.Value > 0
+	}
+	return false
+}
+
+// forInStatement keeps the iterator on the stack while the loop runs:
+//
+//	collection; oIterStart; loop: oIterNext exit; store x; body; oJmp loop; exit: oPop
+func (c *Compiler) forInStatement(node *TForInStatement) {
+	pos := node.Position()
+	c.expression(node.Collection)
+	c.emit(oIterStart, 0, pos)
+	c.beginLoop()
+	loop := c.currentLocation()
+	exitJump := c.emitJump(oIterNext, pos)
+	c.storeVariable(node.Variable, pos)
+	c.statementList(node.Body)
+	c.emit(oJmp, loop, pos)
+	c.patchJump(exitJump)
+	c.endLoop(loop)
+	c.emit(oPop, 0, pos)
+}
+
+// switchStatement keeps the subject on the stack while the labels are
+// tested in order, the first case with a matching label runs:
+//
+//	subject; oDup; label; oEq; oJmpIfTrue case1; oDup; low; high; oInRange; oJmpIfTrue case1; ...
+//	oPop; else; oJmp end; case1: oPop; body1; oJmp end; ... end:
+//
+// When all the labels are integer constants close to each other the tests
+// are replaced by a single oJumpTable.
+func (c *Compiler) switchStatement(node *TSwitchStatement) {
+	pos := node.Position()
+	c.checkCaseLabels(node)
+	c.expression(node.Subject)
+	table := c.jumpTable(node)
+	caseJumps := make([][]int, len(node.Cases))
+	if table != nil {
+		c.emit(oJumpTable, c.module.addJumpTable(table), pos)
+	} else {
+		for i, clause := range node.Cases {
+			for _, label := range clause.Labels {
+				c.emit(oDup, 0, label.Position())
+				c.expression(label.Low)
+				if label.High == nil {
+					c.emit(oEq, 0, label.Position())
+				} else {
+					c.expression(label.High)
+					c.emit(oInRange, 0, label.Position())
+				}
+				caseJumps[i] = append(caseJumps[i], c.emitJump(oJmpIfTrue, label.Position()))
+			}
+		}
+	}
+	otherwise := c.currentLocation()
+	c.emit(oPop, 0, pos)
+	c.statementList(node.Else)
+	endJumps := []int{c.emitJump(oJmp, pos)}
+	caseStarts := make([]int, len(node.Cases))
+	for i, clause := range node.Cases {
+		caseStarts[i] = c.currentLocation()
+		for _, jump := range caseJumps[i] {
+			c.patchJump(jump)
+		}
+		c.emit(oPop, 0, clause.Position())
+		c.statementList(clause.Body)
+		if i < len(node.Cases)-1 {
+			endJumps = append(endJumps, c.emitJump(oJmp, clause.Position()))
+		}
+	}
+	for _, jump := range endJumps {
+		c.patchJump(jump)
+	}
+	if table != nil {
+		table.otherwise = otherwise
+		for i, caseIndex := range table.targets {
+			if caseIndex < 0 {
+				table.targets[i] = otherwise
+			} else {
+				table.targets[i] = caseStarts[caseIndex]
+			}
+		}
+	}
+}
+
+const (
+	minJumpTableValues = 4    // fewer values are tested one by one
+	maxJumpTableSize   = 1024 // entries of the largest jump table
+)
+
+// jumpTable returns a jump table when the labels of the switch are integer
+// constants or ranges of them that do not overlap, and at least half of the
+// values from the lowest to the highest have a case. Until the code of the
+// cases is generated the targets are the indexes of the cases, -1 for none.
+func (c *Compiler) jumpTable(node *TSwitchStatement) *TJumpTable {
+	type intRange struct{ low, high, caseIndex int }
+	var ranges []intRange
+	count := 0
+	for i, clause := range node.Cases {
+		for _, label := range clause.Labels {
+			low, ok := integerConstant(label.Low)
+			if !ok {
+				return nil
+			}
+			high := low
+			if label.High != nil {
+				if high, ok = integerConstant(label.High); !ok {
+					return nil
+				}
+			}
+			if high-low >= maxJumpTableSize {
+				return nil
+			}
+			ranges = append(ranges, intRange{low, high, i})
+			count += high - low + 1
+		}
+	}
+	if count < minJumpTableValues {
+		return nil
+	}
+	low, high := ranges[0].low, ranges[0].high
+	for _, r := range ranges {
+		if r.low < low {
+			low = r.low
+		}
+		if r.high > high {
+			high = r.high
+		}
+	}
+	size := high - low + 1
+	if size > maxJumpTableSize || size > 2*count {
+		return nil
+	}
+	table := &TJumpTable{low: low, targets: make([]int, size), labels: make([]int, size)}
+	for i := range table.targets {
+		table.targets[i], table.labels[i] = -1, -1
+	}
+	for label, r := range ranges {
+		for value := r.low; value <= r.high; value++ {
+			if table.labels[value-low] >= 0 {
+				return nil // overlapping labels are tested in order
+			}
+			table.targets[value-low], table.labels[value-low] = r.caseIndex, label
+		}
+	}
+	return table
+}
+
+// checkCaseLabels reports empty constant ranges and constant labels that can
+// never match because every value they accept is taken by a previous label
+func (c *Compiler) checkCaseLabels(node *TSwitchStatement) {
+	type constantLabel struct {
+		low, high TMachineStackRecord
+		line      int
+	}
+	var seen []constantLabel
+	for _, clause := range node.Cases {
+		for _, label := range clause.Labels {
+			low, ok := constantValue(label.Low)
+			if !ok {
+				continue
+			}
+			high := low
+			if label.High != nil {
+				if high, ok = constantValue(label.High); !ok {
+					continue
+				}
+				order, ordered := compareOrdered(low, high)
+				if !ordered {
+					c.error(label.Position(), ErrCompile, "the bounds of a case range must be numbers or strings, found %s..%s", low.typeName(), high.typeName())
+				}
+				if order > 0 {
+					c.error(label.Position(), ErrCompile, "case range %s..%s is empty", elementString(low), elementString(high))
+				}
+			}
+			current := constantLabel{low, high, label.Line}
+			for _, previous := range seen {
+				if labelCovers(previous.low, previous.high, current.low, current.high) {
+					text := elementString(low)
+					if label.High != nil {
+						text += ".." + elementString(high)
+					}
+					c.error(label.Position(), ErrDuplicateCase, "case label %s is already handled at line %d", text, previous.line)
+				}
+			}
+			seen = append(seen, current)
+		}
+	}
+}
+
+// labelCovers tells if every value of low..high is also in outerLow..outerHigh,
+// a label that is not a range has the same low and high
+func labelCovers(outerLow, outerHigh, low, high TMachineStackRecord) bool {
+	if valuesEqual(outerLow, outerHigh) && valuesEqual(low, high) {
+		return valuesEqual(outerLow, low)
+	}
+	fromLow, lowOk := compareOrdered(outerLow, low)
+	toHigh, highOk := compareOrdered(high, outerHigh)
+	return lowOk && highOk && fromLow <= 0 && toHigh <= 0
+}
+
+// constantValue returns the value of a literal number, string or boolean,
+// ok is false for any other expression
+func constantValue(expression TExpression) (value TMachineStackRecord, ok bool) {
+	switch node := expression.(type) {
+	case *TIntegerLiteral:
+		return TMachineStackRecord{stackType: stInteger, iValue: node.Value}, true
+	case *TFloatLiteral:
+		return TMachineStackRecord{stackType: stDouble, dValue: node.Value}, true
+	case *TStringLiteral:
+		return TMachineStackRecord{stackType: stString, sValue: node.Value}, true
+	case *TBooleanLiteral:
+		return TMachineStackRecord{stackType: stBoolean, bValue: node.Value}, true
+	case *TUnaryExpression:
+		if value, ok = constantValue(node.Operand); ok && node.Operator == T_MINUS {
+			switch value.stackType {
+			case stInteger:
+				return TMachineStackRecord{stackType: stInteger, iValue: -value.iValue}, true
+			case stDouble:
+				return TMachineStackRecord{stackType: stDouble, dValue: -value.dValue}, true
+			}
+		}
+	}
+	return TMachineStackRecord{}, false
+}
+
+func integerConstant(expression TExpression) (int, bool) {
+	value, ok := constantValue(expression)
+	return value.iValue, ok && value.stackType == stInteger
+}
+
+func (c *Compiler) returnStatement(node *TReturnStatement) {
+	if c.scope.function == nil {
+		c.error(node.Position(), ErrReturnOutsideFunction, "return can only be used inside a function")
+	}
+	switch len(node.Values) {
+	case 0:
+		c.emit(oPushNone, 0, node.Position())
+	case 1:
+		c.values(node.Values[0])
+	default:
+		for _, value := range node.Values {
+			c.expression(value)
+		}
+		c.emit(oBuildValues, len(node.Values), node.Position())
+	}
+	c.emit(oReturn, 0, node.Position())
+}
+
+// functionDef compiles the body into a function object and assigns it to
+// a variable with the function name: a global at module level, a local
+// holding a closure in a function
+func (c *Compiler) functionDef(node *TFunctionDef) {
+	function := &TFunctionObject{Name: node.Name, Parameters: node.Parameters}
+	if c.scope.function == nil {
+		c.module.functions[node.Name] = function
+		c.compileFunction(function, node.Body, node.Position())
+		c.emit(oPushc, c.module.addConstant(TMachineStackRecord{stackType: stFunction, lValue: function}), node.Position())
+	} else {
+		c.scope.functions[node.Name] = function
+		c.closure(function, c.compileFunction(function, node.Body, node.Position()), node.Position())
+	}
+	c.storeVariable(node.Name, node.Position())
+}
+
+func (c *Compiler) functionExpression(node *TFunctionExpression) {
+	function := &TFunctionObject{Name: "anonymous", Parameters: node.Parameters}
+	c.closure(function, c.compileFunction(function, node.Body, node.Position()), node.Position())
+}
+
+// closure pushes the references to the captured variables and creates a
+// closure of function with them:
+//
+//	oLoadLocal slot | oRefUpvalue index ...; oClosure function
+func (c *Compiler) closure(function *TFunctionObject, upvalues []TUpvalue, pos TSourcePosition) {
+	for _, upvalue := range upvalues {
+		if upvalue.isLocal {
+			c.emit(oRefLocal, upvalue.index, pos) // the slot holds the reference
+		} else {
+			c.emit(oRefUpvalue, upvalue.index, pos)
+		}
+	}
+	c.emit(oClosure, c.module.addConstant(TMachineStackRecord{stackType: stFunction, lValue: function}), pos)
+}
+
+// compileFunction compiles body into function in a new scope nested in the
+// current one and returns the variables of the enclosing functions it uses
+func (c *Compiler) compileFunction(function *TFunctionObject, body []TStatement, pos TSourcePosition) []TUpvalue {
+	enclosing := c.scope
+	c.scope = &TCompilerScope{function: function, enclosing: enclosing, locals: make(map[string]int),
+		references: make(map[string]bool), globals: globalNames(body), functions: make(map[string]*TFunctionObject)}
+	hasDefault := false
+	for _, parameter := range function.Parameters {
+		if parameter.IsRef && parameter.Default != nil {
+			c.error(parameter.Position(), ErrCompile, "ref parameter '%s' cannot have a default value", parameter.Name)
+		}
+		if hasDefault && parameter.Default == nil && !parameter.IsVariadic {
+			c.error(parameter.Position(), ErrCompile, "parameter '%s' needs a default value, it follows a parameter with one", parameter.Name)
+		}
+		hasDefault = hasDefault || parameter.Default != nil
+		if _, ok := c.scope.locals[parameter.Name]; ok {
+			c.error(parameter.Position(), ErrDuplicateParameter, "duplicate parameter '%s' in function '%s'", parameter.Name, function.Name)
+		}
+		if c.scope.globals[parameter.Name] {
+			c.error(parameter.Position(), ErrCompile, "parameter '%s' of function '%s' cannot be declared global", parameter.Name, function.Name)
+		}
+		c.scope.locals[parameter.Name] = len(c.scope.locals)
+		c.scope.references[parameter.Name] = parameter.IsRef
+	}
+	c.collectLocals(body)
+	c.declareFunctions(body)
+	c.defaultValues(function.Parameters)
+	c.captureLocals(body, pos)
+	c.statementList(body)
+	c.emit(oPushNone, 0, pos)
+	c.emit(oReturn, 0, pos)
+	function.Code = c.scope.code
+	function.nLocals = len(c.scope.locals)
+	function.localNames = make([]string, function.nLocals)
+	for name, slot := range c.scope.locals {
+		function.localNames[slot] = name
+	}
+	upvalues := c.scope.upvalues
+	function.upvalueNames = make([]string, len(upvalues))
+	for i, upvalue := range upvalues {
+		function.upvalueNames[i] = upvalue.name
+	}
+	c.scope = enclosing
+	return upvalues
+}
+
+// defaultValues gives their default value to the parameters that did not
+// receive an argument, the default can use the parameters before it:
+//
+//	oHasValue slot; oJmpIfTrue next; default; oStoreLocal slot; next:
+func (c *Compiler) defaultValues(parameters []TParameter) {
+	for slot, parameter := range parameters {
+		if parameter.Default == nil {
+			continue
+		}
+		c.emit(oHasValue, slot, parameter.Position())
+		next := c.emitJump(oJmpIfTrue, parameter.Position())
+		c.expression(parameter.Default)
+		c.emit(oStoreLocal, slot, parameter.Position())
+		c.patchJump(next)
+	}
+}
+
+// captureLocals finds the locals used by the functions defined in body.
+// They are kept in a box, shared with the closures, that oBox creates when
+// the function starts. A ref parameter already holds a reference.
+func (c *Compiler) captureLocals(body []TStatement, pos TSourcePosition) {
+	var slots []int
+	inspect(body, func(node TNode) bool {
+		var names map[string]bool
+		switch node := node.(type) {
+		case *TFunctionExpression:
+			names = freeNames(node.Parameters, node.Body)
+		case *TFunctionDef:
+			names = freeNames(node.Parameters, node.Body)
+		default:
+			return true
+		}
+		for name := range names {
+			if slot, ok := c.scope.locals[name]; ok && !c.scope.references[name] {
+				c.scope.references[name] = true
+				slots = append(slots, slot)
+			}
+		}
+		return false
+	})
+	sort.Ints(slots)
+	for _, slot := range slots {
+		c.emit(oBox, slot, pos)
+	}
+}
+
+// freeNames returns the variables used by a function that are not its
+// parameters or declared global, including the ones used by the functions
+// defined inside it
+func freeNames(parameters []TParameter, body []TStatement) map[string]bool {
+	names := make(map[string]bool)
+	visit := func(node TNode) bool {
+		switch node := node.(type) {
+		case *TIdentifier:
+			names[node.Name] = true
+		case *TForStatement:
+			names[node.Variable] = true
+		case *TForInStatement:
+			names[node.Variable] = true
+		case *TFunctionExpression:
+			for name := range freeNames(node.Parameters, node.Body) {
+				names[name] = true
+			}
+			return false
+		case *TFunctionDef:
+			names[node.Name] = true
+			for name := range freeNames(node.Parameters, node.Body) {
+				names[name] = true
+			}
+			return false
+		}
+		return true
+	}
+	inspect(body, visit)
+	inspectDefaults(parameters, visit)
+	for _, parameter := range parameters {
+		delete(names, parameter.Name)
+	}
+	for name := range globalNames(body) {
+		delete(names, name)
+	}
+	return names
+}
+
+// globalNames returns the names declared global in a function body,
+// without the declarations of the functions defined inside it
+func globalNames(body []TStatement) map[string]bool {
+	names := make(map[string]bool)
+	inspect(body, func(node TNode) bool {
+		switch node := node.(type) {
+		case *TGlobalStatement:
+			for _, name := range node.Names {
+				names[name] = true
+			}
+		case *TFunctionExpression, *TFunctionDef:
+			return false
+		}
+		return true
+	})
+	return names
+}
+
+// declareFunctions creates the function objects of the function
+// definitions of a module or a function body before its code is compiled,
+// so calls that appear before a definition know which parameters are
+// passed by reference
+func (c *Compiler) declareFunctions(statements []TStatement) {
+	for _, statement := range statements {
+		if node, ok := statement.(*TFunctionDef); ok {
+			function := &TFunctionObject{Name: node.Name, Parameters: node.Parameters}
+			if c.scope.function == nil {
+				c.module.functions[node.Name] = function
+			} else {
+				c.scope.functions[node.Name] = function
+			}
+		}
+	}
+}
+
+// collectAssigned records in the module the names that can hold something
+// else than the function defined with that name: the targets of assignments,
+// loop variables, the arguments of ref parameters and the names of several
+// function definitions, in this program or in the ones compiled before
+func (c *Compiler) collectAssigned(statements []TStatement) {
+	definitions := make(map[string][]*TFunctionDef)
+	inspect(statements, func(node TNode) bool {
+		if node, ok := node.(*TFunctionDef); ok {
+			definitions[node.Name] = append(definitions[node.Name], node)
+		}
+		return true
+	})
+	for name, nodes := range definitions {
+		if _, ok := c.module.functions[name]; ok || len(nodes) > 1 {
+			c.module.assigned[name] = true
+		}
+	}
+	hasRefParameter := func(name string) bool {
+		for _, node := range definitions[name] {
+			for _, parameter := range node.Parameters {
+				if parameter.IsRef {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	assign := func(target TExpression) {
+		if identifier, ok := target.(*TIdentifier); ok {
+			c.module.assigned[identifier.Name] = true
+		}
+	}
+	inspect(statements, func(node TNode) bool {
+		switch node := node.(type) {
+		case *TAssignment:
+			assign(node.Target)
+		case *TMultipleAssignment:
+			for _, target := range node.Targets {
+				assign(target)
+			}
+		case *TForStatement:
+			c.module.assigned[node.Variable] = true
+		case *TForInStatement:
+			c.module.assigned[node.Variable] = true
+		case *TCallExpression:
+			if callee, ok := node.Function.(*TIdentifier); ok && hasRefParameter(callee.Name) {
+				for _, argument := range node.Arguments {
+					assign(argument)
+				}
+			}
+		}
+		return true
+	})
+}
+
+// calleeFunction returns the function called by name, nil when the
+// function is not known at compile time or the name may hold another value
+func (c *Compiler) calleeFunction(callee TExpression) *TFunctionObject {
+	identifier, ok := callee.(*TIdentifier)
+	if !ok || c.module.assigned[identifier.Name] {
+		return nil
+	}
+	scope := c.scope
+	if _, ok := scope.locals[identifier.Name]; !ok {
+		scope = c.enclosingScope(identifier.Name)
+	}
+	if scope != nil && scope.function != nil {
+		return scope.functions[identifier.Name]
+	}
+	return c.module.functions[identifier.Name]
+}
+
+// call checks the arguments given to a function known at compile time and
+// passes references to its ref parameters. The names of the arguments given
+// by name are a list constant, oMultipleValues lets the function return
+// several values when multiple is true:
+//
+//	function; arguments; [oMultipleValues]; oCall count
+//	function; arguments; oPushc names; [oMultipleValues]; oCallNamed count
+func (c *Compiler) call(node *TCallExpression, multiple bool) {
+	pos := node.Position()
+	c.expression(node.Function)
+	var parameters []TParameter
+	parameterOf := make([]int, len(node.Arguments)) // -1 for the arguments of a variadic parameter
+	if function := c.calleeFunction(node.Function); function != nil {
+		binding, _, err := matchArguments(function.Name, function.Parameters, len(node.Arguments)-len(node.Names), node.Names)
+		if err != nil {
+			c.error(pos, ErrArgumentMismatch, "%s", err)
+		}
+		parameters = function.Parameters
+		for i := range parameterOf {
+			parameterOf[i] = -1
+		}
+		for p, argument := range binding {
+			if argument >= 0 {
+				parameterOf[argument] = p
+			}
+		}
+	}
+	for i, argument := range node.Arguments {
+		if parameters != nil && parameterOf[i] >= 0 && parameters[parameterOf[i]].IsRef {
+			c.reference(argument, parameters[parameterOf[i]])
+		} else {
+			c.expression(argument)
+		}
+	}
+	opCode := oCall
+	if len(node.Names) > 0 {
+		names := make([]TMachineStackRecord, len(node.Names))
+		for i, name := range node.Names {
+			names[i] = TMachineStackRecord{stackType: stString, sValue: name}
+		}
+		c.emit(oPushc, c.module.addConstant(newListValue(names)), pos)
+		opCode = oCallNamed
+	}
+	if multiple {
+		c.emit(oMultipleValues, 0, pos)
+	}
+	c.emit(opCode, len(node.Arguments), pos)
+}
+
+// values compiles an expression whose result can be several values returned
+// by a function
+func (c *Compiler) values(expression TExpression) {
+	if call, ok := expression.(*TCallExpression); ok {
+		c.call(call, true)
+	} else {
+		c.expression(expression)
+	}
+}
+
+// reference pushes a reference to the variable or list element given as
+// the argument of ref parameter
+func (c *Compiler) reference(argument TExpression, parameter TParameter) {
+	pos := argument.Position()
+	switch node := argument.(type) {
+	case *TIdentifier:
+		c.variableReference(node.Name, pos)
+	case *TIndexExpression:
+		c.expression(node.Target)
+		for _, index := range node.Indices {
+			c.expression(index)
+		}
+		c.emit(oRefIndexed, len(node.Indices), pos)
+	default:
+		c.error(pos, ErrNotAssignable, "argument of ref parameter '%s' must be a variable or a list element", parameter.Name)
+	}
+}
+
+// variableReference pushes a reference to the variable name
+func (c *Compiler) variableReference(name string, pos TSourcePosition) {
+	if slot, ok := c.scope.locals[name]; ok && c.scope.references[name] {
+		c.emit(oRefLocal, slot, pos) // pass on the reference received by the caller
+	} else if ok {
+		c.emit(oRefLocal, slot, pos)
+	} else if index, ok := c.resolveUpvalue(c.scope, name); ok {
+		c.emit(oRefUpvalue, index, pos)
+	} else {
+		c.emit(oRefGlobal, c.module.lookupGlobal(name), pos)
+	}
+}
+
+// collectLocals gives a slot to every variable assigned in a function body,
+// other than the locals of the enclosing functions. Any other name used in
+// the body refers to a global variable.
+func (c *Compiler) collectLocals(statements []TStatement) {
+	declare := func(name string) {
+		if _, ok := c.scope.locals[name]; !ok && !c.scope.globals[name] && !c.enclosingLocal(name) {
+			c.scope.locals[name] = len(c.scope.locals)
+		}
+	}
+	for _, statement := range statements {
+		switch node := statement.(type) {
+		case *TAssignment:
+			if target, ok := node.Target.(*TIdentifier); ok {
+				declare(target.Name)
+			}
+		case *TMultipleAssignment:
+			for _, target := range node.Targets {
+				if target, ok := target.(*TIdentifier); ok {
+					declare(target.Name)
+				}
+			}
+		case *TIfStatement:
+			c.collectLocals(node.Then)
+			c.collectLocals(node.Else)
+		case *TWhileStatement:
+			c.collectLocals(node.Body)
+		case *TRepeatStatement:
+			c.collectLocals(node.Body)
+		case *TForStatement:
+			declare(node.Variable)
+			c.collectLocals(node.Body)
+		case *TForInStatement:
+			declare(node.Variable)
+			c.collectLocals(node.Body)
+		case *TSwitchStatement:
+			for _, clause := range node.Cases {
+				c.collectLocals(clause.Body)
+			}
+			c.collectLocals(node.Else)
+		case *TFunctionDef:
+			declare(node.Name)
+		}
+	}
+}
+
+func (c *Compiler) expression(expression TExpression) {
+	pos := expression.Position()
+	switch node := expression.(type) {
+	case *TIntegerLiteral:
+		c.emit(oPushi, node.Value, pos)
+	case *TFloatLiteral:
+		c.emit(oPushc, c.module.addConstant(TMachineStackRecord{stackType: stDouble, dValue: node.Value}), pos)
+	case *TStringLiteral:
+		c.emit(oPushc, c.module.addConstant(TMachineStackRecord{stackType: stString, sValue: node.Value}), pos)
+	case *TBooleanLiteral:
+		if node.Value {
+			c.emit(oPushb, 1, pos)
+		} else {
+			c.emit(oPushb, 0, pos)
+		}
+	case *TListLiteral:
+		for _, element := range node.Elements {
+			c.expression(element)
+		}
+		c.emit(oBuildList, len(node.Elements), pos)
+	case *TMapLiteral:
+		for i := range node.Keys {
+			c.expression(node.Keys[i])
+			c.expression(node.Values[i])
+		}
+		c.emit(oBuildMap, len(node.Keys), pos)
+	case *TIdentifier:
+		c.loadVariable(node.Name, pos)
+	case *TIndexExpression:
+		c.expression(node.Target)
+		for _, index := range node.Indices {
+			c.expression(index)
+		}
+		c.emit(oLoadIndexed, len(node.Indices), pos)
+	case *TSliceExpression:
+		for _, bound := range []TExpression{node.Low, node.High} {
+			if bound != nil {
+				c.expression(bound)
+			} else {
+				c.emit(oPushNone, 0, pos)
+			}
+		}
+		c.emit(oBuildSlice, 0, pos)
+	case *TCallExpression:
+		c.call(node, false)
+	case *TFunctionExpression:
+		c.functionExpression(node)
+	case *TUnaryExpression:
+		c.expression(node.Operand)
+		if node.Operator == T_NOT {
+			c.emit(oNot, 0, pos)
+		} else {
+			c.emit(oUmi, 0, pos)
+		}
+	case *TBinaryExpression:
+		if node.Operator == T_AND || node.Operator == T_OR {
+			c.shortCircuit(node)
+			break
+		}
+		c.expression(node.Left)
+		c.expression(node.Right)
+		c.emit(c.binaryOpCode(node.Operator, pos), 0, pos)
+	default:
+		c.error(pos, ErrCompile, "unsupported expression")
+	}
+}
+
+// shortCircuit only evaluates the right operand of and (or) when the left
+// one is True (False), the result is the value of the last operand evaluated:
+//
+//	left; oJmpIfFalseOrPop end; right; oCheckBoolean; end:
+func (c *Compiler) shortCircuit(node *TBinaryExpression) {
+	opCode := oJmpIfFalseOrPop
+	if node.Operator == T_OR {
+		opCode = oJmpIfTrueOrPop
+	}
+	c.expression(node.Left)
+	jump := c.emitJump(opCode, node.Position())
+	c.expression(node.Right)
+	c.emit(oCheckBoolean, int(node.Operator), node.Position())
+	c.patchJump(jump)
+}
+
+func (c *Compiler) binaryOpCode(operator TokenCode, pos TSourcePosition) OpCode {
+	switch operator {
+	case T_PLUS:
+		return oAdd
+	case T_MINUS:
+		return oSub
+	case T_MULT:
+		return oMult
+	case T_DIVIDE:
+		return oDivide
+	case T_DIV:
+		return oDiv
+	case T_MOD:
+		return oMod
+	case T_POWER:
+		return oPower
+	case T_EQUAL:
+		return oEq
+	case T_NOT_EQ:
+		return oNotEq
+	case T_LESS:
+		return oLt
+	case T_LESS_EQ:
+		return oLe
+	case T_GREATER:
+		return oGt
+	case T_GREATER_EQ:
+		return oGe
+	case T_IN:
+		return oIn
+	case T_XOR:
+		return oXor
+	}
+	c.error(pos, ErrCompile, "internal error: unknown binary operator %s", TokenSpelling(operator))
+	return oHalt
+}
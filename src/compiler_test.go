@@ -0,0 +1,138 @@
+package src
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// compile scans, parses and compiles script into a new module without running it
+func compile(script string) error {
+	sc := NewScanner()
+	sc.ScanString(script)
+	if err := sc.NextToken(); err != nil {
+		return err
+	}
+	program, err := NewSyntaxAnalisis(sc).Program()
+	if err != nil {
+		return err
+	}
+	module := NewModule()
+	registerStandardBuiltins(module)
+	return NewCompiler(module).Compile(program)
+}
+
+func TestCompileDiagnostics(t *testing.T) {
+	tests := []struct {
+		script string
+		code   ErrorCode
+	}{
+		{`x = 1 + 2 * 3; y = x - 1`, 0},
+		{`x = {1, 2}; y = x[0]`, 0},
+		{`return 1`, ErrReturnOutsideFunction},
+		{`function f(a, a) return a end`, ErrDuplicateParameter},
+		{`function f(ref a) a = 1 end; f(1)`, ErrNotAssignable},
+		{`for i = 1 to 5 step 0 do end`, ErrCompile},
+		{`for i = 5 downto 1 step -1 do end`, ErrCompile},
+		{`for i = 5 to 1 step -1 do end`, 0},
+		{`x = 1; 5`, ErrExpectingStatement},
+		{`break`, ErrOutsideLoop},
+		{`continue`, ErrOutsideLoop},
+		{`function f() break end`, ErrOutsideLoop},
+		{`while True do function f() continue end end`, ErrOutsideLoop},
+		{`a = 1 < 2 < 3`, ErrChainedComparison},
+		{`a = 1 == 2 != 3`, ErrChainedComparison},
+		{`a = (1 < 2) == True`, 0},
+		{`if True then x = 1 else x = 2 elseif False then x = 3 end`, ErrUnexpectedToken},
+		{`switch 1 case 1: x = 1 case 1: x = 2 end`, ErrDuplicateCase},
+		{`switch 1 case 1..5: x = 1 case 5: x = 2 end`, ErrDuplicateCase},
+		{`switch 1 case 5..1: x = 1 end`, ErrCompile},
+		{`global a`, ErrCompile},
+		{`function f(x) global x end`, ErrCompile},
+		{`function f(ref a = 1) return a end`, ErrCompile},
+		{`function f(a = 1, b) return a end`, ErrCompile},
+		{`function f(*a, b) return a end`, ErrUnexpectedToken},
+		{`function f(a) return a end; x = f(a = 1, 2)`, ErrUnexpectedToken},
+		{`function f(a) return a end; x = f(1, 2)`, ErrArgumentMismatch},
+		{`function f(a, b = 1) return a end; x = f()`, ErrArgumentMismatch},
+		{`function f(a) return a end; x = f(b = 1)`, ErrArgumentMismatch},
+		{`function f(a) return a end; x = f(1, a = 1)`, ErrArgumentMismatch},
+		// a function whose name is assigned is only checked at run time
+		{`function f(a) return a end; f = function(a, b) return a + b end; x = f(1, 2)`, 0},
+		{`function f(a) return a end; for f = 1 to 2 do end; x = f(1, 2)`, 0},
+		{`function f(a) return a end; function f(a, b) return b end; x = f(1, 2)`, 0},
+		{`function f(a, *rest) return rest end; x = f(1, 2, 3)`, 0},
+		{`x, f(1) = 1, 2`, ErrInvalidAssignment},
+		{`x, y = 1, 2, 3`, ErrValueCount},
+		{`x = 1, 2`, ErrValueCount},
+		{`function f() return 1, 2 end; a, b = f()`, 0},
+	}
+	for _, test := range tests {
+		err := compile(test.script)
+		if code := diagnosticCode(t, err); code != test.code {
+			t.Errorf("%s: expecting error %v, found %v", test.script, test.code, err)
+		}
+	}
+}
+
+// TestCompileSampleScripts compiles every sample, including the ones that
+// TestSampleScripts cannot run like repeat.rh that never ends
+func TestCompileSampleScripts(t *testing.T) {
+	syntaxErrors := map[string]bool{"comments2.rh": true, "repeatString.rh": true}
+	files, err := filepath.Glob("../SampleScripts/*.rh")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no sample scripts found: %v", err)
+	}
+	for _, file := range files {
+		script, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compile(string(script))
+		if syntaxErrors[filepath.Base(file)] != (err != nil) {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+}
+
+func TestUnknownBinaryOperator(t *testing.T) {
+	program := &TASTProgram{Statements: []TStatement{&TAssignment{
+		Target: &TIdentifier{Name: "x"},
+		Value:  &TBinaryExpression{Operator: T_SEMICOLON, Left: &TIntegerLiteral{Value: 1}, Right: &TIntegerLiteral{Value: 2}},
+	}}}
+	err := NewCompiler(NewModule()).Compile(program)
+	if code := diagnosticCode(t, err); code != ErrCompile {
+		t.Errorf("expecting error %v, found %v", ErrCompile, err)
+	}
+}
+
+// TestSyntaxErrorRecovery checks that the parser reports every syntax error
+// of a program in one pass
+func TestSyntaxErrorRecovery(t *testing.T) {
+	tests := []struct {
+		script  string
+		columns []int // columns of the errors, all of them on line 1
+		code    ErrorCode
+	}{
+		{`x = ; y = 2 +; z = 3`, []int{5, 14}, ErrExpectingFactor},
+		{`end; x = 1; until`, []int{1, 13}, ErrUnexpectedToken},
+		{`x = 1 y = 2`, []int{7}, ErrUnexpectedToken},
+		{`x = (1; y = 2`, []int{7}, ErrUnexpectedToken},
+		{`if x then y = end; while do end; println(1)`, []int{15, 26, 29}, ErrExpectingFactor},
+	}
+	for _, test := range tests {
+		list, ok := compile(test.script).(DiagnosticList)
+		if !ok || len(list) != len(test.columns) {
+			t.Errorf("%s: expecting %d errors, found %v", test.script, len(test.columns), list)
+			continue
+		}
+		if list[0].Code != test.code {
+			t.Errorf("%s: expecting error %v first, found %v", test.script, test.code, list[0])
+		}
+		for i, diagnostic := range list {
+			if diagnostic.Line != 1 || diagnostic.Column != test.columns[i] {
+				t.Errorf("%s: expecting an error at 1:%d, found %v", test.script, test.columns[i], diagnostic)
+			}
+		}
+	}
+}
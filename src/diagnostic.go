@@ -0,0 +1,132 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Severity byte
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// ErrorCode identifies the kind of a diagnostic, the hundreds digit tells
+// the phase that reported it: 1 scanner, 2 parser, 3 compiler, 4 virtual machine
+type ErrorCode int
+
+const (
+	ErrUnexpectedCharacter ErrorCode = 100 + iota
+	ErrInvalidNumber
+	ErrIntegerOverflow
+	ErrExponentOverflow
+	ErrUnterminatedString
+	ErrUnterminatedComment
+	ErrFileNotFound
+)
+
+const (
+	ErrUnexpectedToken ErrorCode = 200 + iota
+	ErrExpectingStatement
+	ErrExpectingFactor
+	ErrInvalidAssignment
+	ErrChainedComparison
+)
+
+const (
+	ErrCompile ErrorCode = 300 + iota
+	ErrReturnOutsideFunction
+	ErrDuplicateParameter
+	ErrNotAssignable
+	ErrOutsideLoop
+	ErrDuplicateCase
+	ErrArgumentMismatch
+	ErrValueCount
+)
+
+const (
+	ErrRuntime ErrorCode = 400 + iota
+	ErrTypeMismatch
+	ErrDivisionByZero
+	ErrUndefinedVariable
+	ErrStackOverflow
+	ErrStackUnderflow
+	ErrIndexOutOfRange
+	ErrDimensionMismatch
+	ErrKeyNotFound
+)
+
+func (c ErrorCode) String() string {
+	return fmt.Sprintf("E%d", int(c))
+}
+
+// Diagnostic is an error or a warning found while scanning, parsing,
+// compiling or running a Rhodus program. It satisfies the error interface.
+type Diagnostic struct {
+	Severity Severity
+	Code     ErrorCode
+	Message  string
+	File     string
+	Line     int
+	Column   int
+}
+
+func newDiagnostic(code ErrorCode, line, column int, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{
+		Severity: SeverityError,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+		Line:     line,
+		Column:   column,
+	}
+}
+
+// Error formats the diagnostic as file:line:column: severity code: message
+func (d *Diagnostic) Error() string {
+	location := ""
+	if d.File != "" {
+		location = d.File + ":"
+	}
+	if d.Line > 0 {
+		location += fmt.Sprintf("%d:", d.Line)
+		if d.Column > 0 {
+			location += fmt.Sprintf("%d:", d.Column)
+		}
+	}
+	if location != "" {
+		location += " "
+	}
+	return fmt.Sprintf("%s%s %s: %s", location, d.Severity, d.Code, d.Message)
+}
+
+// DiagnosticList is the error returned when the analysis of a program
+// goes on after the first error, it holds every error found
+type DiagnosticList []*Diagnostic
+
+func (l DiagnosticList) Error() string {
+	messages := make([]string, len(l))
+	for i, diagnostic := range l {
+		messages[i] = diagnostic.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// recoverDiagnostic stores in err the diagnostic raised with panic by the
+// scanner, parser, compiler or virtual machine, any other panic is propagated
+func recoverDiagnostic(err *error) {
+	if r := recover(); r != nil {
+		diagnostic, ok := r.(*Diagnostic)
+		if !ok {
+			panic(r)
+		}
+		*err = diagnostic
+	}
+}
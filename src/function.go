@@ -0,0 +1,83 @@
+package src
+
+import "fmt"
+
+// TFunctionObject is a compiled Rhodus function. It lives in the module
+// constant table and is called by oCall with its arguments on the stack.
+type TFunctionObject struct {
+	Name       string
+	Parameters []TParameter
+	Code       TProgram
+	nLocals    int      // parameters plus local variables
+	localNames []string // name of every local slot, for error messages
+
+	upvalueNames []string               // variables of the enclosing functions, for error messages
+	upvalues     []*TMachineStackRecord // the captured variables of a closure created by oClosure
+}
+
+func (f *TFunctionObject) arity() int {
+	return len(f.Parameters)
+}
+
+// variadic reports if the last parameter collects the extra arguments
+func (f *TFunctionObject) variadic() bool {
+	return len(f.Parameters) > 0 && f.Parameters[len(f.Parameters)-1].IsVariadic
+}
+
+// matchArguments pairs the arguments of a call with the parameters of
+// function: positional arguments come first and the last len(names) are given
+// by name. binding holds the argument of every parameter, -1 when it takes
+// its default value, and extra the arguments collected by the variadic
+// parameter. The compiler uses it to check calls to known functions and the
+// virtual machine to bind the arguments of the others.
+func matchArguments(function string, parameters []TParameter, positional int, names []string) (binding []int, extra []int, err error) {
+	fixed, required := len(parameters), 0
+	if fixed > 0 && parameters[fixed-1].IsVariadic {
+		fixed -= 1
+	}
+	for _, parameter := range parameters[:fixed] {
+		if parameter.Default == nil {
+			required += 1
+		}
+	}
+	binding = make([]int, len(parameters))
+	for i := range binding {
+		binding[i] = -1
+	}
+	for i := 0; i < positional; i++ {
+		if i < fixed {
+			binding[i] = i
+		} else if fixed < len(parameters) {
+			extra = append(extra, i)
+		} else if required == fixed {
+			return nil, nil, fmt.Errorf("function '%s' expects %d arguments, found %d", function, fixed, positional+len(names))
+		} else {
+			return nil, nil, fmt.Errorf("function '%s' expects at most %d arguments, found %d", function, fixed, positional+len(names))
+		}
+	}
+	for i, name := range names {
+		p := 0
+		for p < fixed && parameters[p].Name != name {
+			p += 1
+		}
+		if p == fixed {
+			return nil, nil, fmt.Errorf("function '%s' has no parameter '%s'", function, name)
+		}
+		if binding[p] >= 0 {
+			return nil, nil, fmt.Errorf("parameter '%s' of function '%s' is given more than once", name, function)
+		}
+		binding[p] = positional + i
+	}
+	for p, parameter := range parameters[:fixed] {
+		if binding[p] >= 0 || parameter.Default != nil {
+			continue
+		}
+		if len(names) > 0 {
+			return nil, nil, fmt.Errorf("function '%s' expects a value for parameter '%s'", function, parameter.Name)
+		} else if required == fixed && fixed == len(parameters) {
+			return nil, nil, fmt.Errorf("function '%s' expects %d arguments, found %d", function, fixed, positional)
+		}
+		return nil, nil, fmt.Errorf("function '%s' expects at least %d arguments, found %d", function, required, positional)
+	}
+	return binding, extra, nil
+}
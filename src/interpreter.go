@@ -0,0 +1,141 @@
+package src
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Interpreter runs Rhodus code from a Go host program. Every evaluation
+// is compiled into the same module, so global variables and functions
+// defined by one call to EvalString or EvalFile are visible to the next.
+//
+//	in := src.NewInterpreter()
+//	in.SetGlobal("rate", 0.04)
+//	if err := in.EvalString(`total = 500 + 500*rate`); err != nil {
+//		...
+//	}
+//	total, err := in.GetGlobal("total")
+type Interpreter struct {
+	sc     *Scanner
+	sy     *SyntaxAnalisis
+	module *Module
+	vm     *VM
+	stderr io.Writer
+}
+
+// NewInterpreter returns an interpreter that writes the output of print
+// and println to os.Stdout and diagnostics to os.Stderr
+func NewInterpreter() *Interpreter {
+	in := &Interpreter{
+		sc:     NewScanner(),
+		module: NewModule(),
+		vm:     NewVM(DEFAULT_STACK_SIZE),
+		stderr: os.Stderr,
+	}
+	in.sy = NewSyntaxAnalisis(in.sc)
+	registerStandardBuiltins(in.module)
+	return in
+}
+
+// RegisterFunction makes the Go function fn callable from Rhodus as name.
+// The number of arguments is checked on every call, and the arguments are
+// converted to the types of the parameters of fn: any integer or floating
+// point kind, bool, string or interface{}, other types are rejected when fn
+// is registered. fn can be variadic and may return nothing, a
+// value, or a value and an error that stops the script.
+//
+//	in.RegisterFunction("hypot", func(x, y float64) float64 {
+//		return math.Sqrt(x*x + y*y)
+//	})
+func (in *Interpreter) RegisterFunction(name string, fn interface{}) error {
+	builtin, err := newBuiltinFunction(name, fn)
+	if err != nil {
+		return err
+	}
+	in.module.registerBuiltin(builtin)
+	return nil
+}
+
+// SetStdout sets the writer that receives the output of print and println
+func (in *Interpreter) SetStdout(w io.Writer) {
+	in.vm.stdout = w
+}
+
+// SetStderr sets the writer that receives the diagnostics of a failed
+// evaluation, use ioutil.Discard to only get them as the returned error
+func (in *Interpreter) SetStderr(w io.Writer) {
+	in.stderr = w
+}
+
+// SetMaxCallDepth sets the number of nested function calls allowed, a
+// deeper recursion stops the script with a stack overflow error. The
+// default is DEFAULT_MAX_CALL_DEPTH.
+func (in *Interpreter) SetMaxCallDepth(depth int) {
+	in.vm.SetMaxCallDepth(depth)
+}
+
+// EvalString scans, compiles and runs code. The error is a *Diagnostic, or
+// a DiagnosticList when the code has syntax errors.
+func (in *Interpreter) EvalString(code string) error {
+	return in.eval(code, "")
+}
+
+// EvalFile runs the Rhodus script fileName, diagnostics report the file name
+func (in *Interpreter) EvalFile(fileName string) error {
+	fileContent, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		diagnostic := &Diagnostic{Code: ErrFileNotFound, Message: "could not open the file", File: fileName}
+		fmt.Fprintln(in.stderr, diagnostic)
+		return diagnostic
+	}
+	return in.eval(string(fileContent), fileName)
+}
+
+func (in *Interpreter) eval(code string, fileName string) error {
+	err := in.run(code, fileName)
+	if err != nil {
+		fmt.Fprintln(in.stderr, err)
+	}
+	return err
+}
+
+func (in *Interpreter) run(code string, fileName string) error {
+	in.sc.ScanString(code)
+	in.sc.FileName = fileName
+	in.module.Name = fileName
+	if err := in.sc.NextToken(); err != nil { // start the scanner
+		return err
+	}
+	program, err := in.sy.Program()
+	if err != nil {
+		return err
+	}
+	if err := NewCompiler(in.module).Compile(program); err != nil {
+		return err
+	}
+	return in.vm.RunModule(in.module)
+}
+
+// SetGlobal assigns a Go value to the global variable name. Integers,
+// floats, booleans, strings and []interface{} lists of them are supported.
+func (in *Interpreter) SetGlobal(name string, value interface{}) error {
+	record, err := toMachineStackRecord(value)
+	if err != nil {
+		return err
+	}
+	in.module.globals[in.module.lookupGlobal(name)].Value = record
+	in.module.assigned[name] = true
+	return nil
+}
+
+// GetGlobal returns the value of the global variable name as an int,
+// float64, bool, string or []interface{} for a list
+func (in *Interpreter) GetGlobal(name string) (interface{}, error) {
+	index, ok := in.module.globalIndex[name]
+	if !ok || in.module.globals[index].Value.stackType == stNone {
+		return nil, &Diagnostic{Code: ErrUndefinedVariable, Message: fmt.Sprintf("variable '%s' has no value", name)}
+	}
+	return in.module.globals[index].Value.toGoValue(), nil
+}
@@ -0,0 +1,50 @@
+package src
+
+// TIteratorObject walks the elements of a list, the characters of a string
+// or the keys of a map for a for-in loop
+type TIteratorObject struct {
+	container TMachineStackRecord
+	keys      []TMachineStackRecord // keys of a map when the loop starts
+	runes     []rune                // characters of a string
+	position  int
+}
+
+func newIterator(container TMachineStackRecord) *TIteratorObject {
+	iterator := &TIteratorObject{container: container}
+	switch container.stackType {
+	case stMap:
+		iterator.keys = container.lValue.(*TMapObject).keys()
+	case stString:
+		iterator.runes = []rune(container.sValue)
+	}
+	return iterator
+}
+
+// next returns the next value, ok is false at the end. A list is read
+// while the loop runs, so elements added by the body are visited. The keys
+// of a map are the ones it had when the loop started, less the ones the
+// body removes.
+func (it *TIteratorObject) next() (value TMachineStackRecord, ok bool) {
+	switch it.container.stackType {
+	case stList:
+		elements := it.container.lValue.(*TListObject).elements
+		if it.position < len(elements) {
+			value, ok = elements[it.position], true
+		}
+	case stMap:
+		m := it.container.lValue.(*TMapObject)
+		for it.position < len(it.keys) {
+			if entry, _ := m.lookup(it.keys[it.position]); entry != nil {
+				value, ok = it.keys[it.position], true
+				break
+			}
+			it.position += 1
+		}
+	case stString:
+		if it.position < len(it.runes) {
+			value, ok = TMachineStackRecord{stackType: stString, sValue: string(it.runes[it.position])}, true
+		}
+	}
+	it.position += 1
+	return value, ok
+}
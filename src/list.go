@@ -0,0 +1,109 @@
+package src
+
+import (
+	"strings"
+)
+
+// TListObject holds the elements of a Rhodus list. A list value is a
+// reference to its TListObject, assigning a list or passing it to a
+// function shares the elements instead of copying them.
+type TListObject struct {
+	elements []TMachineStackRecord
+}
+
+func newListValue(elements []TMachineStackRecord) TMachineStackRecord {
+	return TMachineStackRecord{stackType: stList, lValue: &TListObject{elements: elements}}
+}
+
+// toString formats the list as {1, 2, {3, 4}}, strings are quoted and a
+// list that contains itself prints as {...} where it repeats
+func (l *TListObject) toString() string {
+	return l.format(map[interface{}]bool{})
+}
+
+// format formats the list, printing holds the lists and maps that enclose it
+func (l *TListObject) format(printing map[interface{}]bool) string {
+	if printing[l] {
+		return "{...}"
+	}
+	printing[l] = true
+	defer delete(printing, l)
+	items := make([]string, len(l.elements))
+	for i, element := range l.elements {
+		items[i] = formatElement(element, printing)
+	}
+	return "{" + strings.Join(items, ", ") + "}"
+}
+
+// elementString formats a value inside a list or a map, strings are quoted
+func elementString(value TMachineStackRecord) string {
+	return formatElement(value, map[interface{}]bool{})
+}
+
+func formatElement(value TMachineStackRecord, printing map[interface{}]bool) string {
+	switch value.stackType {
+	case stString:
+		return "\"" + value.sValue + "\""
+	case stList:
+		return value.lValue.(*TListObject).format(printing)
+	case stMap:
+		return value.lValue.(*TMapObject).format(printing)
+	}
+	return value.toString()
+}
+
+// equals compares two lists element by element
+func (l *TListObject) equals(other *TListObject) bool {
+	return l.equalsVisiting(other, map[[2]interface{}]bool{})
+}
+
+// equalsVisiting compares two lists, a pair already in compared is being
+// compared by an enclosing call and is taken as equal so that lists that
+// contain themselves compare in finite time
+func (l *TListObject) equalsVisiting(other *TListObject, compared map[[2]interface{}]bool) bool {
+	if l == other || compared[[2]interface{}{l, other}] {
+		return true
+	}
+	if len(l.elements) != len(other.elements) {
+		return false
+	}
+	compared[[2]interface{}{l, other}] = true
+	for i := range l.elements {
+		if !valuesEqualVisiting(l.elements[i], other.elements[i], compared) {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesEqual is the == of Rhodus: numbers compare by value, lists,
+// matrices and maps by their elements, functions by identity, and values of
+// different types are never equal
+func valuesEqual(a, b TMachineStackRecord) bool {
+	return valuesEqualVisiting(a, b, map[[2]interface{}]bool{})
+}
+
+func valuesEqualVisiting(a, b TMachineStackRecord, compared map[[2]interface{}]bool) bool {
+	if isNumber(a) && isNumber(b) {
+		result, ordered := compareNumbers(a, b)
+		return ordered && result == 0
+	}
+	if a.stackType != b.stackType {
+		return false
+	}
+	switch a.stackType {
+	case stBoolean:
+		return a.bValue == b.bValue
+	case stString:
+		return a.sValue == b.sValue
+	case stList:
+		return a.lValue.(*TListObject).equalsVisiting(b.lValue.(*TListObject), compared)
+	case stMatrix:
+		return a.lValue.(*TMatrixObject).equals(b.lValue.(*TMatrixObject))
+	case stMap:
+		return a.lValue.(*TMapObject).equalsVisiting(b.lValue.(*TMapObject), compared)
+	case stNone:
+		return true
+	}
+	return a.lValue == b.lValue
+}
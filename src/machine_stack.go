@@ -1,5 +1,14 @@
 package src
 
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type TStackType byte
 
 const (
@@ -8,6 +17,16 @@ const (
 	stDouble
 	stString
 	stList
+	stMatrix
+	stMap
+	stFunction
+	stBuiltin
+	stReference // variable passed to a ref parameter, lValue is a *TMachineStackRecord
+	stSlice     // subscript low:high, lValue is a *TSliceObject
+	stIterator  // state of a for-in loop, lValue is a *TIteratorObject
+	stValues    // several values returned by a function, lValue is a *TListObject
+	stNone      // unassigned variable or the result of a function without return
+	stMissing   // parameter without argument until it gets its default value
 )
 
 type TMachineStackRecord struct {
@@ -21,3 +40,183 @@ type TMachineStackRecord struct {
 
 type PMachineStackRecord *TMachineStackRecord
 type TMachineStack []TMachineStackRecord
+
+func (r TMachineStackRecord) typeName() string {
+	switch r.stackType {
+	case stInteger:
+		return "integer"
+	case stBoolean:
+		return "boolean"
+	case stDouble:
+		return "double"
+	case stString:
+		return "string"
+	case stList:
+		return "list"
+	case stMatrix:
+		return "matrix"
+	case stMap:
+		return "map"
+	case stFunction, stBuiltin:
+		return "function"
+	case stReference:
+		return "reference"
+	case stSlice:
+		return "slice"
+	case stIterator:
+		return "iterator"
+	case stValues:
+		return "multiple values"
+	}
+	return "none"
+}
+
+func (r TMachineStackRecord) toString() string {
+	switch r.stackType {
+	case stInteger:
+		return strconv.Itoa(r.iValue)
+	case stBoolean:
+		if r.bValue {
+			return "True"
+		}
+		return "False"
+	case stDouble:
+		return formatDouble(r.dValue)
+	case stString:
+		return r.sValue
+	case stFunction:
+		return "<function " + r.lValue.(*TFunctionObject).Name + ">"
+	case stBuiltin:
+		return "<builtin " + r.lValue.(*TBuiltinFunction).Name + ">"
+	case stList:
+		return r.lValue.(*TListObject).toString()
+	case stMatrix:
+		return r.lValue.(*TMatrixObject).toString()
+	case stMap:
+		return r.lValue.(*TMapObject).toString()
+	}
+	return "None"
+}
+
+// formatDouble writes a double with a decimal point so it can be told apart from an integer
+func formatDouble(value float64) string {
+	s := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
+// toMachineStackRecord converts a Go value into a Rhodus value, a
+// []interface{} becomes a list and a map[string]interface{} a map with
+// the keys in alphabetical order
+func toMachineStackRecord(value interface{}) (TMachineStackRecord, error) {
+	switch value := value.(type) {
+	case int:
+		return TMachineStackRecord{stackType: stInteger, iValue: value}, nil
+	case int32:
+		return TMachineStackRecord{stackType: stInteger, iValue: int(value)}, nil
+	case int64:
+		return TMachineStackRecord{stackType: stInteger, iValue: int(value)}, nil
+	case float32:
+		return TMachineStackRecord{stackType: stDouble, dValue: float64(value)}, nil
+	case float64:
+		return TMachineStackRecord{stackType: stDouble, dValue: value}, nil
+	case bool:
+		return TMachineStackRecord{stackType: stBoolean, bValue: value}, nil
+	case string:
+		return TMachineStackRecord{stackType: stString, sValue: value}, nil
+	case TMachineStackRecord:
+		return value, nil
+	case []interface{}:
+		elements := make([]TMachineStackRecord, len(value))
+		for i, item := range value {
+			element, err := toMachineStackRecord(item)
+			if err != nil {
+				return TMachineStackRecord{}, err
+			}
+			elements[i] = element
+		}
+		return newListValue(elements), nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		m := newMapObject()
+		for _, name := range names {
+			item, err := toMachineStackRecord(value[name])
+			if err != nil {
+				return TMachineStackRecord{}, err
+			}
+			entry, _ := m.entry(TMachineStackRecord{stackType: stString, sValue: name})
+			entry.value = item
+		}
+		return newMapValue(m), nil
+	}
+	// the other integer and floating point kinds, named types included
+	switch v := reflect.ValueOf(value); {
+	case v.IsValid() && isIntKind(v.Kind()):
+		return TMachineStackRecord{stackType: stInteger, iValue: int(v.Int())}, nil
+	case v.IsValid() && isUintKind(v.Kind()) && v.Uint() <= math.MaxInt64:
+		return TMachineStackRecord{stackType: stInteger, iValue: int(v.Uint())}, nil
+	case v.IsValid() && isFloatKind(v.Kind()):
+		return TMachineStackRecord{stackType: stDouble, dValue: v.Float()}, nil
+	}
+	return TMachineStackRecord{}, &Diagnostic{Code: ErrTypeMismatch, Message: fmt.Sprintf("cannot convert %T to a Rhodus value", value)}
+}
+
+// toGoValue converts a Rhodus value into the equivalent Go value, a list
+// becomes a []interface{}, a matrix a [][]float64 and a map a
+// map[interface{}]interface{}
+func (r TMachineStackRecord) toGoValue() interface{} {
+	return r.goValue(map[interface{}]interface{}{})
+}
+
+// goValue converts r, converted holds the Go values of the lists and maps
+// already converted so that one that contains itself becomes a Go value
+// that does
+func (r TMachineStackRecord) goValue(converted map[interface{}]interface{}) interface{} {
+	switch r.stackType {
+	case stInteger:
+		return r.iValue
+	case stBoolean:
+		return r.bValue
+	case stDouble:
+		return r.dValue
+	case stString:
+		return r.sValue
+	case stList:
+		if items, ok := converted[r.lValue]; ok {
+			return items
+		}
+		elements := r.lValue.(*TListObject).elements
+		items := make([]interface{}, len(elements))
+		converted[r.lValue] = items
+		for i, element := range elements {
+			items[i] = element.goValue(converted)
+		}
+		return items
+	case stMatrix:
+		m := r.lValue.(*TMatrixObject)
+		rows := make([][]float64, m.rows)
+		for i := range rows {
+			rows[i] = append([]float64(nil), m.data[i*m.cols:(i+1)*m.cols]...)
+		}
+		return rows
+	case stMap:
+		if items, ok := converted[r.lValue]; ok {
+			return items
+		}
+		items := make(map[interface{}]interface{})
+		converted[r.lValue] = items
+		for _, entry := range r.lValue.(*TMapObject).entries {
+			items[entry.key.goValue(converted)] = entry.value.goValue(converted)
+		}
+		return items
+	case stNone:
+		return nil
+	}
+	return r.lValue
+}
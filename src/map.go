@@ -0,0 +1,147 @@
+package src
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// TMapEntry is a key and its value, entries are kept by pointer so a
+// reference to a value stays valid when other keys are added or removed
+type TMapEntry struct {
+	key   TMachineStackRecord
+	value TMachineStackRecord
+}
+
+// TMapObject associates string or number keys with values. The keys are
+// iterated and printed in the order they were first added. Like a list, a
+// map value is a reference to its TMapObject.
+type TMapObject struct {
+	entries []*TMapEntry
+	index   map[interface{}]int // position of every key in entries
+}
+
+func newMapObject() *TMapObject {
+	return &TMapObject{index: make(map[interface{}]int)}
+}
+
+func newMapValue(m *TMapObject) TMachineStackRecord {
+	return TMachineStackRecord{stackType: stMap, lValue: m}
+}
+
+// mapKey returns the Go value used to look up key, a double with an
+// integer value is the same key as the integer
+func mapKey(key TMachineStackRecord) (interface{}, error) {
+	switch key.stackType {
+	case stInteger:
+		return key.iValue, nil
+	case stDouble:
+		if key.dValue == math.Trunc(key.dValue) && math.Abs(key.dValue) < 1<<53 {
+			return int(key.dValue), nil
+		}
+		return key.dValue, nil
+	case stString:
+		return key.sValue, nil
+	}
+	return nil, fmt.Errorf("map keys must be strings or numbers, found %s", key.typeName())
+}
+
+// lookup returns the entry of key, nil if the map does not have the key
+func (m *TMapObject) lookup(key TMachineStackRecord) (*TMapEntry, error) {
+	goKey, err := mapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if position, ok := m.index[goKey]; ok {
+		return m.entries[position], nil
+	}
+	return nil, nil
+}
+
+// entry returns the entry of key, adding it with no value when it is missing
+func (m *TMapObject) entry(key TMachineStackRecord) (*TMapEntry, error) {
+	goKey, err := mapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if position, ok := m.index[goKey]; ok {
+		return m.entries[position], nil
+	}
+	entry := &TMapEntry{key: key, value: TMachineStackRecord{stackType: stNone}}
+	m.index[goKey] = len(m.entries)
+	m.entries = append(m.entries, entry)
+	return entry, nil
+}
+
+// remove deletes key from the map, it returns false if the key was missing
+func (m *TMapObject) remove(key TMachineStackRecord) (bool, error) {
+	goKey, err := mapKey(key)
+	if err != nil {
+		return false, err
+	}
+	position, ok := m.index[goKey]
+	if !ok {
+		return false, nil
+	}
+	delete(m.index, goKey)
+	m.entries = append(m.entries[:position], m.entries[position+1:]...)
+	for i := position; i < len(m.entries); i++ {
+		k, _ := mapKey(m.entries[i].key)
+		m.index[k] = i
+	}
+	return true, nil
+}
+
+func (m *TMapObject) keys() []TMachineStackRecord {
+	keys := make([]TMachineStackRecord, len(m.entries))
+	for i, entry := range m.entries {
+		keys[i] = entry.key
+	}
+	return keys
+}
+
+// equals is true when both maps have the same keys with equal values, the
+// order of the keys does not matter
+func (m *TMapObject) equals(other *TMapObject) bool {
+	return m.equalsVisiting(other, map[[2]interface{}]bool{})
+}
+
+// equalsVisiting compares two maps like TListObject.equalsVisiting
+func (m *TMapObject) equalsVisiting(other *TMapObject, compared map[[2]interface{}]bool) bool {
+	if m == other || compared[[2]interface{}{m, other}] {
+		return true
+	}
+	if len(m.entries) != len(other.entries) {
+		return false
+	}
+	compared[[2]interface{}{m, other}] = true
+	for _, entry := range m.entries {
+		otherEntry, _ := other.lookup(entry.key)
+		if otherEntry == nil || !valuesEqualVisiting(entry.value, otherEntry.value, compared) {
+			return false
+		}
+	}
+	return true
+}
+
+// toString formats the map as {"name": "Ann", "age": 30}, the empty map is {:}
+func (m *TMapObject) toString() string {
+	return m.format(map[interface{}]bool{})
+}
+
+// format formats the map, a map that contains itself prints as {...}
+func (m *TMapObject) format(printing map[interface{}]bool) string {
+	if len(m.entries) == 0 {
+		return "{:}"
+	}
+	if printing[m] {
+		return "{...}"
+	}
+	printing[m] = true
+	defer delete(printing, m)
+	items := make([]string, len(m.entries))
+	for i, entry := range m.entries {
+		items[i] = elementString(entry.key) + ": " + formatElement(entry.value, printing)
+	}
+	return "{" + strings.Join(items, ", ") + "}"
+}
@@ -0,0 +1,174 @@
+package src
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TMatrixObject is a dense matrix of doubles stored by rows. Like a list, a
+// matrix value is a reference to its TMatrixObject.
+type TMatrixObject struct {
+	rows int
+	cols int
+	data []float64
+}
+
+// TSliceObject is the value of a subscript low:high, a bound without an
+// expression is None and means the start or the end of the dimension
+type TSliceObject struct {
+	low  TMachineStackRecord
+	high TMachineStackRecord
+}
+
+// maxMatrixElements bounds the size of a matrix, running out of memory
+// cannot be recovered and would stop the program embedding Rhodus
+const maxMatrixElements = 1 << 24
+
+// checkMatrixSize returns an error when a rows x cols matrix is too large
+func checkMatrixSize(rows, cols int) error {
+	if rows > 0 && cols > maxMatrixElements/rows {
+		return fmt.Errorf("a %dx%d matrix exceeds the limit of %d elements", rows, cols, maxMatrixElements)
+	}
+	return nil
+}
+
+func newMatrix(rows, cols int) *TMatrixObject {
+	return &TMatrixObject{rows: rows, cols: cols, data: make([]float64, rows*cols)}
+}
+
+func newMatrixValue(m *TMatrixObject) TMachineStackRecord {
+	return TMachineStackRecord{stackType: stMatrix, lValue: m}
+}
+
+func identityMatrix(n int) *TMatrixObject {
+	m := newMatrix(n, n)
+	for i := 0; i < n; i++ {
+		m.set(i, i, 1)
+	}
+	return m
+}
+
+// matrixFromList builds a matrix from a list of rows, every row is a list
+// with the same number of numbers
+func matrixFromList(list *TListObject) (*TMatrixObject, error) {
+	if len(list.elements) == 0 {
+		return newMatrix(0, 0), nil
+	}
+	var m *TMatrixObject
+	for i, row := range list.elements {
+		if row.stackType != stList {
+			return nil, fmt.Errorf("row %d of the matrix must be a list, found %s", i, row.typeName())
+		}
+		elements := row.lValue.(*TListObject).elements
+		if m == nil {
+			m = newMatrix(len(list.elements), len(elements))
+		}
+		if len(elements) != m.cols {
+			return nil, fmt.Errorf("row %d of the matrix has %d elements, expecting %d", i, len(elements), m.cols)
+		}
+		for j, element := range elements {
+			if !isNumber(element) {
+				return nil, fmt.Errorf("matrix elements must be numbers, found %s", element.typeName())
+			}
+			m.set(i, j, toDouble(element))
+		}
+	}
+	return m, nil
+}
+
+func (m *TMatrixObject) get(i, j int) float64 {
+	return m.data[i*m.cols+j]
+}
+
+func (m *TMatrixObject) set(i, j int, value float64) {
+	m.data[i*m.cols+j] = value
+}
+
+// resize changes the dimensions keeping the elements that still fit, new
+// elements are zero
+func (m *TMatrixObject) resize(rows, cols int) {
+	data := make([]float64, rows*cols)
+	for i := 0; i < m.rows && i < rows; i++ {
+		for j := 0; j < m.cols && j < cols; j++ {
+			data[i*cols+j] = m.get(i, j)
+		}
+	}
+	m.rows, m.cols, m.data = rows, cols, data
+}
+
+// subMatrix returns a copy of the rows [rowLow, rowHigh) and the columns [colLow, colHigh)
+func (m *TMatrixObject) subMatrix(rowLow, rowHigh, colLow, colHigh int) *TMatrixObject {
+	result := newMatrix(rowHigh-rowLow, colHigh-colLow)
+	for i := rowLow; i < rowHigh; i++ {
+		for j := colLow; j < colHigh; j++ {
+			result.set(i-rowLow, j-colLow, m.get(i, j))
+		}
+	}
+	return result
+}
+
+// add returns m + other, or m - other when subtract is true, both
+// matrices must have the same dimensions
+func (m *TMatrixObject) add(other *TMatrixObject, subtract bool) *TMatrixObject {
+	result := newMatrix(m.rows, m.cols)
+	for i := range m.data {
+		if subtract {
+			result.data[i] = m.data[i] - other.data[i]
+		} else {
+			result.data[i] = m.data[i] + other.data[i]
+		}
+	}
+	return result
+}
+
+// multiply returns the matrix product, m.cols must be equal to other.rows
+func (m *TMatrixObject) multiply(other *TMatrixObject) *TMatrixObject {
+	result := newMatrix(m.rows, other.cols)
+	for i := 0; i < m.rows; i++ {
+		for j := 0; j < other.cols; j++ {
+			sum := 0.0
+			for k := 0; k < m.cols; k++ {
+				sum += m.get(i, k) * other.get(k, j)
+			}
+			result.set(i, j, sum)
+		}
+	}
+	return result
+}
+
+func (m *TMatrixObject) scale(factor float64) *TMatrixObject {
+	result := newMatrix(m.rows, m.cols)
+	for i := range m.data {
+		result.data[i] = m.data[i] * factor
+	}
+	return result
+}
+
+func (m *TMatrixObject) equals(other *TMatrixObject) bool {
+	if m.rows != other.rows || m.cols != other.cols {
+		return false
+	}
+	for i := range m.data {
+		if m.data[i] != other.data[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// toString formats the matrix as a list of rows: {{1.0, 0.0}, {0.0, 1.0}}
+func (m *TMatrixObject) toString() string {
+	rows := make([]string, m.rows)
+	for i := 0; i < m.rows; i++ {
+		items := make([]string, m.cols)
+		for j := 0; j < m.cols; j++ {
+			items[j] = formatDouble(m.get(i, j))
+		}
+		rows[i] = "{" + strings.Join(items, ", ") + "}"
+	}
+	return "{" + strings.Join(rows, ", ") + "}"
+}
+
+func (m *TMatrixObject) dimensions() string {
+	return fmt.Sprintf("%dx%d", m.rows, m.cols)
+}
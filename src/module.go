@@ -1,18 +1,54 @@
 package src
 
+// TGlobalVariable is the storage of a module level variable
+type TGlobalVariable struct {
+	Name  string
+	Value TMachineStackRecord
+}
+
 type Module struct {
-	Name        string
-	Code        TProgram
-	symbolTable *TSymbolTable
+	Name          string
+	Code          TProgram
+	constantTable []TMachineStackRecord
+	jumpTables    []*TJumpTable
+	globals       []*TGlobalVariable
+	globalIndex   map[string]int
+	functions     map[string]*TFunctionObject // functions declared in the module, by name
+	assigned      map[string]bool             // variables assigned other than by their function definition
 }
 
 func NewModule() *Module {
 	m := &Module{
-		Code: TProgram{},
+		Code:        TProgram{},
+		globalIndex: make(map[string]int),
+		functions:   make(map[string]*TFunctionObject),
+		assigned:    make(map[string]bool),
 	}
 	return m
 }
 
 func (m *Module) ClearCode() {
+	m.Code = TProgram{}
+}
+
+// addConstant stores value in the constant table and returns its index
+func (m *Module) addConstant(value TMachineStackRecord) int {
+	m.constantTable = append(m.constantTable, value)
+	return len(m.constantTable) - 1
+}
+
+func (m *Module) addJumpTable(table *TJumpTable) int {
+	m.jumpTables = append(m.jumpTables, table)
+	return len(m.jumpTables) - 1
+}
 
+// lookupGlobal returns the index of the global variable name, creating
+// an unassigned variable the first time the name is seen
+func (m *Module) lookupGlobal(name string) int {
+	if index, ok := m.globalIndex[name]; ok {
+		return index
+	}
+	m.globals = append(m.globals, &TGlobalVariable{Name: name, Value: TMachineStackRecord{stackType: stNone}})
+	m.globalIndex[name] = len(m.globals) - 1
+	return len(m.globals) - 1
 }
@@ -3,12 +3,69 @@ package src
 type OpCode byte
 
 const (
-	oPushi OpCode = iota // Push integer constant onto stack
+	oPushi        OpCode = iota // Push integer constant onto stack
+	oPushb                      // Push boolean constant, index is 0 (False) or 1 (True)
+	oPushc                      // Push entry index of the module constant table
+	oPushNone                   // Push the "no value" result of a function without return
+	oLoad                       // Push the value of global variable index
+	oStore                      // Pop the stack into global variable index
+	oLoadLocal                  // Push the value of local variable slot index
+	oStoreLocal                 // Pop the stack into local variable slot index
+	oLoadRef                    // Push the value of the variable referenced by ref parameter slot index
+	oStoreRef                   // Pop the stack into the variable referenced by ref parameter slot index
+	oRefGlobal                  // Push a reference to global variable index
+	oRefLocal                   // Box local variable slot index in place and push the reference to its box
+	oRefIndexed                 // Pop index subscripts and the container, push a reference to the element
+	oLoadUpvalue                // Push the value of captured variable index of the running closure
+	oStoreUpvalue               // Pop the stack into captured variable index of the running closure
+	oRefUpvalue                 // Push a reference to captured variable index of the running closure
+	oHasValue                   // Push False if local slot index is a parameter without argument, True otherwise
+	oBox                        // Replace local slot index by a reference to its value, for a variable captured by closures
+	oClosure                    // Pop the references to the captured variables and push a closure of function constant index
 	oAdd
 	oSub
 	oMult
 	oDivide
+	oDiv   // Integer division
+	oMod   // Integer remainder
 	oUmi   // Unary minus
 	oPower // x^y
+	oEq
+	oNotEq
+	oLt
+	oLe
+	oGt
+	oGe
+	oIn      // Pop the container and the value, push True if the value is a key, an element or a substring
+	oInRange // Pop the high and low bounds and a value, push True if low <= value <= high
+	oXor
+	oNot
+	oCheckBoolean    // Fail if the top of the stack is not a boolean, index is the token of the operator
+	oJmp             // Jump to instruction index
+	oJmpIfTrue       // Pop the stack, jump to instruction index if it is True
+	oJmpIfFalse      // Pop the stack, jump to instruction index if it is False
+	oJmpIfTrueOrPop  // Jump to instruction index if the top of the stack is True, otherwise pop it (or)
+	oJmpIfFalseOrPop // Jump to instruction index if the top of the stack is False, otherwise pop it (and)
+	oJumpTable       // Jump through the module jump table index with the value on top of the stack, the value stays
+	oPop             // Discard the top of the stack
+	oDup             // Duplicate the top of the stack
+	oRoll            // Move the value index places below the top of the stack to the top
+	oUnpack          // Pop a list of index elements and push its elements, the last one on top
+	oIterStart       // Pop a list, string or map and push an iterator over it
+	oForTest         // Pop the loop variable, jump to index if it went past the limit and step below the top of the stack
+	oDowntoStep      // Negate the step of a downto loop on top of the stack, it must not be negative
+	oIterNext        // Push the next value of the iterator on top of the stack, jump to index at the end
+	oBuildList       // Pop index values and push a list holding them
+	oBuildValues     // Pop index values and push them as the several values returned by a function
+	oBuildSlice      // Pop the high and low bounds and push the slice low:high
+	oBuildMap        // Pop index key and value pairs and push a map holding them
+	oLoadIndexed     // Pop index subscripts and the container, push the element
+	oStoreIndexed    // Pop the value, index subscripts and the container, store the value in the element
+	oMultipleValues  // Let the next call return several values
+	oCall            // Call the function below index arguments on the stack
+	oCallNamed       // Pop the list of the names of the last arguments and call the function below index arguments
+	oReturn          // Return from the current function with the value on top of the stack
+	oPrint           // Pop and print index values
+	oPrintln         // Pop and print index values followed by a new line
 	oHalt
 )
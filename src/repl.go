@@ -16,56 +16,38 @@ const (
 )
 
 type Repl struct {
-	sc *Scanner
-	sy *SyntaxAnalisis
+	interpreter *Interpreter
 }
 
 func NewRepl() *Repl {
 	repl := &Repl{
-		sc: NewScanner(),
+		interpreter: NewInterpreter(),
 	}
-	repl.sy = NewSyntaxAnalisis(repl.sc)
+	repl.interpreter.SetStderr(os.Stdout)
 
 	return repl
 }
 
-func (r *Repl) Start(mode string) {
-	var sourceCode string
-	r.sy = NewSyntaxAnalisis(r.sc)
+// Start reads and runs commands from the standard input until quit
+// or the end of the input
+func (r *Repl) Start() {
 	scanner := bufio.NewScanner(os.Stdin)
 	displayWelcome()
 	for { // start the loop
 		displayPrompt()
-		if mode != "debug" {
-			scanned := scanner.Scan()
-			if !scanned {
-				return
-			}
-			sourceCode = scanner.Text()
+		if !scanner.Scan() {
+			fmt.Println()
+			return
 		}
-		sourceCode = `run c:\a1\test1.rh`
+		sourceCode := strings.TrimSpace(scanner.Text())
 		if sourceCode == "quit" {
 			break
 		}
-		if sourceCode[0:3] == "run" {
-			fileName := strings.TrimSpace(sourceCode[3:])
-			if _, err := os.Stat(fileName); os.IsNotExist(err) {
-				fmt.Println("File not found:" + fileName)
-			} else {
-				fileContent, err := ioutil.ReadFile(fileName)
-				if err != nil {
-					panic(err)
-				}
-				r.runCode(string(fileContent))
-			}
+		if runCommand(sourceCode, r) {
 			continue
-		} else {
-			if runCommand(sourceCode) {
-				continue
-			}
 		}
 		if sourceCode != "" {
-			r.runCode(sourceCode)
+			r.runCode(sourceCode, "")
 		}
 	}
 }
@@ -87,45 +69,51 @@ func GetSampleScriptsDir() string {
 		panic(err)
 	}
 	parent := filepath.Dir(wd)
-	return fmt.Sprintf("%s\\SampleScripts", parent)
+	return filepath.Join(parent, "SampleScripts")
 }
 
-func runCommand(command string) bool {
-	sdir := fmt.Sprintf("%s\\", GetSampleScriptsDir())
-	result := false
-	if command[0:4] == "list" {
-		fileName := command[4:]
-		if _, err := os.Stat(fileName); os.IsNotExist(err) {
-			fmt.Printf("No such file: %s\n", fileName)
+// runCommand executes the repl commands: run, list, edit and dir
+func runCommand(command string, r *Repl) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || (len(fields) > 1 && strings.HasPrefix(fields[1], "=")) {
+		return false // not a command but an assignment such as: dir = 1
+	}
+	argument := strings.TrimSpace(strings.TrimPrefix(command, fields[0]))
+	switch fields[0] {
+	case "run":
+		if argument == "" {
+			return false
+		}
+		r.interpreter.EvalFile(argument)
+	case "list":
+		fileContent, err := ioutil.ReadFile(argument)
+		if err != nil {
+			fmt.Printf("No such file: %s\n", argument)
+		} else {
+			fmt.Println(string(fileContent))
+		}
+	case "edit":
+		if err := exec.Command("notepad.exe", argument).Start(); err != nil {
+			fmt.Println(err)
 		}
-		fmt.Println(ioutil.ReadFile(fileName))
-		result = true
-	} else if command[0:4] == "edit" {
-		fileName := strings.TrimSpace(command[4:])
-		exec.Command("notepad.exe", fileName)
-		result = true
-	} else if command[0:3] == "dir" {
-		var files []string
-		err := filepath.Walk(sdir, func(path string, info os.FileInfo, err error) error {
-			files = append(files, path)
+	case "dir":
+		err := filepath.Walk(GetSampleScriptsDir(), func(path string, info os.FileInfo, err error) error {
+			if err == nil {
+				fmt.Println(path)
+			}
 			return nil
 		})
 		if err != nil {
-			panic(err)
-		}
-		for _, file := range files {
-			fmt.Println(file)
+			fmt.Println(err)
 		}
-		result = true
+	default:
+		return false
 	}
-	return result
+	return true
 }
 
-func (r *Repl) runCode(code string) {
-	r.sc.ScanString(code)
-	r.sc.NextToken() // start the scanner
-	if r.sc.Token() != T_EOF {
-		r.sy.Program()
-	}
-	fmt.Println("Success!")
+// runCode reports any scanner, syntax, compiler or runtime error and
+// leaves the repl ready for the next command
+func (r *Repl) runCode(code string, fileName string) {
+	r.interpreter.eval(code, fileName)
 }
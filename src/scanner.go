@@ -3,8 +3,8 @@ package src
 import (
 	"fmt"
 	"io/ioutil"
-	"math"
 	"os"
+	"strconv"
 )
 
 var keywords map[string]TokenCode
@@ -48,6 +48,7 @@ const (
 	T_ASSIGN
 	T_NOT_EQ
 	T_COLON
+	T_DOTDOT
 	T_SEMICOLON
 	T_COMMA
 	T_POWER
@@ -62,6 +63,7 @@ const (
 	T_IF
 	T_DOWNTO
 	T_ELSE
+	T_ELSEIF
 	T_THEN
 	T_END
 	T_TRUE
@@ -83,9 +85,16 @@ const (
 	T_RETURN
 	T_PRINT
 	T_PRINTLN
+	T_IN
+	T_STEP
+	T_CONTINUE
+	T_SWITCH
+	T_CASE
+	T_GLOBAL
 )
 
 type Scanner struct {
+	FileName     string // reported in diagnostics, empty when scanning a string
 	Token        getTokenFn
 	columnNumber int
 	lineNumber   int
@@ -114,6 +123,8 @@ func (s *Scanner) addKeywords() {
 	keywords["if"] = T_IF
 	keywords["downto"] = T_DOWNTO
 	keywords["else"] = T_ELSE
+	keywords["elseif"] = T_ELSEIF
+	keywords["elif"] = T_ELSEIF
 	keywords["then"] = T_THEN
 	keywords["end"] = T_END
 	keywords["True"] = T_TRUE
@@ -135,6 +146,12 @@ func (s *Scanner) addKeywords() {
 	keywords["return"] = T_RETURN
 	keywords["print"] = T_PRINT
 	keywords["println"] = T_PRINTLN
+	keywords["in"] = T_IN
+	keywords["step"] = T_STEP
+	keywords["continue"] = T_CONTINUE
+	keywords["switch"] = T_SWITCH
+	keywords["case"] = T_CASE
+	keywords["global"] = T_GLOBAL
 }
 
 func (s *Scanner) getTokenCode() TokenCode {
@@ -145,28 +162,39 @@ func (s *Scanner) getTokenCode() TokenCode {
 }
 
 func (s *Scanner) ScanString(str string) {
+	s.FileName = ""
 	s.StreamReader = NewStreamReader(str)
 	s.startScanner()
 }
 
-func (s *Scanner) ScanFile(fileName string) {
+func (s *Scanner) ScanFile(fileName string) error {
 	// check for file exist
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		fmt.Printf("the file does not exist: %s", fileName)
+		return &Diagnostic{Code: ErrFileNotFound, Message: "the file does not exist", File: fileName}
 	}
 	// load file in array of bytes
 	fileStream, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		fmt.Printf("fatal error: could not open the file: %s", fileName)
+		return &Diagnostic{Code: ErrFileNotFound, Message: "could not open the file: " + err.Error(), File: fileName}
 	}
+	s.FileName = fileName
 	s.StreamReader = NewStreamReader(string(fileStream))
 
 	s.startScanner()
+	return nil
 }
 
 func (s *Scanner) startScanner() {
+	s.tokenQueue = s.tokenQueue[:0]
+	s.inMultiLineComment = false
 	s.lineNumber = 1
 	s.columnNumber = 0
+	// ignorar la línea "#!/usr/bin/env rhodus" al inicio de un script ejecutable
+	if len(s.StreamReader.Stream) > 1 && s.StreamReader.Stream[0] == rune('#') && s.StreamReader.Stream[1] == rune('!') {
+		for !s.StreamReader.EndOfStream() && s.StreamReader.Peek() != LF && s.StreamReader.Peek() != CR {
+			s.readRawChar()
+		}
+	}
 	s.ch = s.nextChar()
 }
 
@@ -178,22 +206,25 @@ func (s *Scanner) readRawChar() rune {
 	return s.StreamReader.Read()
 }
 
+// un CR sin LF (finales de línea de Mac clásico) también se trata como LF
 func (s *Scanner) getOSIndependentChar() rune {
 	ch := s.readRawChar()
-	if ch == CR || ch == LF {
-		if ch == CR {
-			ch = s.readRawChar() // get the LF
-			if ch == LF {
-				return ch
-			} else {
-				fmt.Println("expecting line feed character")
-				os.Exit(1)
-			}
+	if ch == CR {
+		if s.StreamReader.Peek() == LF {
+			s.readRawChar() // get the LF
 		}
+		return LF
 	}
 	return ch
 }
 
+// error interrumpe el análisis del token actual, NextToken devuelve el diagnóstico
+func (s *Scanner) error(code ErrorCode, format string, args ...interface{}) {
+	diagnostic := newDiagnostic(code, s.TokenRecord.LineNumber, s.TokenRecord.ColumnNumber, format, args...)
+	diagnostic.File = s.FileName
+	panic(diagnostic)
+}
+
 // retorna el siguiente caracter en el stream de entrada.
 // filtra el LineFeed e incrementa el número de línea.
 func (s *Scanner) nextChar() rune {
@@ -212,13 +243,16 @@ func (s *Scanner) PushBackToken(token TTokenRecord) {
 	s.tokenQueue = append(s.tokenQueue, token)
 }
 
-func (s *Scanner) NextToken() {
+// NextToken lee el siguiente token, devuelve un *Diagnostic si el texto
+// no forma un token válido
+func (s *Scanner) NextToken() (err error) {
+	defer recoverDiagnostic(&err)
 	if len(s.tokenQueue) > 0 {
 		s.TokenRecord = s.tokenQueue[0]
 		if len(s.tokenQueue) > 0 {
 			s.tokenQueue = s.tokenQueue[1:] // discount first element
 		}
-		return
+		return nil
 	}
 	s.skipBlanksAndComments()
 
@@ -228,25 +262,26 @@ func (s *Scanner) NextToken() {
 
 	if isLetter(s.ch) {
 		s.getWord()
-		return
+		return nil
 	}
-	if isDigit(s.ch) || s.ch == rune('.') {
+	if isDigit(s.ch) || (s.ch == rune('.') && s.StreamReader.Peek() != rune('.')) {
 		s.getNumber()
-		return
+		return nil
 	}
 	if s.ch == rune('"') || s.ch == rune('\'') {
 		s.getString(s.ch)
-		return
+		return nil
 	}
 	if s.ch == EOF_CHAR {
 		s.TokenRecord.Token = T_EOF
 		if s.inMultiLineComment {
-			fmt.Println("detected unterminated comment, expecting \"*/\"")
-			os.Exit(1)
+			s.inMultiLineComment = false
+			s.error(ErrUnterminatedComment, "detected unterminated comment, expecting \"*/\"")
 		}
-		return
+		return nil
 	}
 	s.getSpecial()
+	return nil
 }
 
 func (s *Scanner) skipBlanksAndComments() {
@@ -274,9 +309,10 @@ func (s *Scanner) skipSingleLineComment() {
 		s.ch = s.getOSIndependentChar()
 	}
 	if s.ch != EOF_CHAR {
+		s.lineNumber += 1
+		s.columnNumber = 0
 		s.ch = s.nextChar() // skip LF
 	}
-	s.lineNumber += 1
 }
 
 // trata con este tipo de comentario: /* ..... */
@@ -345,42 +381,40 @@ func (s *Scanner) getNumber() {
 				s.TokenRecord.TokenInteger = 10*s.TokenRecord.TokenInteger + singleDigit
 				s.ch = s.nextChar()
 			} else {
-				fmt.Println("integer Overflow, constant value too large to read")
-				os.Exit(1)
+				for isDigit(s.ch) {
+					s.ch = s.nextChar()
+				}
+				s.error(ErrIntegerOverflow, "integer overflow, constant value too large to read")
 			}
 		}
 	}
-	scale := float64(1)
-	if s.ch == rune('.') {
+	// el valor del float se obtiene del texto del número para no acumular errores de redondeo
+	floatString := fmt.Sprintf("%d", s.TokenRecord.TokenInteger)
+	// un '..' después del número es un rango como en 1..10
+	if s.ch == rune('.') && s.StreamReader.Peek() != rune('.') {
 		// es un float. Comenzamos coleccionando la parte decimal
 		s.TokenRecord.Token = T_FLOAT
-		s.TokenRecord.TokenFloat = float64(s.TokenRecord.TokenInteger)
+		floatString += "."
 		s.ch = s.nextChar() // skip the period '.'
 		if isDigit(s.ch) {
 			hasRightHandSide = true
 		}
 
 		for isDigit(s.ch) {
-			scale *= float64(0.1)
-			singleDigit = int32(s.ch) - int32('0')
-			s.TokenRecord.TokenFloat = s.TokenRecord.TokenFloat + (float64(singleDigit) * float64(scale))
+			floatString += string(s.ch)
 			s.ch = s.nextChar()
 		}
 	}
 	// revisamos si tenemos un número
 	if !hasLeftHandSide && !hasRightHandSide {
-		fmt.Println("single period on itw own is not a valid number")
-		os.Exit(1)
+		s.error(ErrInvalidNumber, "single period on its own is not a valid number")
 	}
 
 	exponentSign := 1
 	// Chequear la notación cientifica
 	if s.ch == rune('e') || s.ch == rune('E') {
 		// es un float, comenzamos a coleccionar la parte exponencial
-		if s.TokenRecord.Token == T_INTEGER {
-			s.TokenRecord.Token = T_FLOAT
-			s.TokenRecord.TokenFloat = float64(s.TokenRecord.TokenInteger)
-		}
+		s.TokenRecord.Token = T_FLOAT
 		s.ch = s.nextChar()
 		if s.ch == rune('-') || s.ch == rune('+') {
 			if s.ch == rune('-') {
@@ -390,8 +424,7 @@ func (s *Scanner) getNumber() {
 		}
 		// acumulamos el exponente, revisamos que s.ch sea un digito
 		if !isDigit(s.ch) {
-			fmt.Println("syntax error: number expected in exponent")
-			os.Exit(1)
+			s.error(ErrInvalidNumber, "number expected in exponent")
 		}
 		evalue := int32(0)
 		for isDigit(s.ch) {
@@ -400,17 +433,16 @@ func (s *Scanner) getNumber() {
 				evalue = 10*evalue + singleDigit
 				s.ch = s.nextChar()
 			} else {
-				fmt.Printf("exponent overflow, maximum value for exponent is %d", MAX_EXPONENT)
-				os.Exit(1)
+				for isDigit(s.ch) {
+					s.ch = s.nextChar()
+				}
+				s.error(ErrExponentOverflow, "exponent overflow, maximum value for exponent is %d", MAX_EXPONENT)
 			}
 		}
-
-		evalue *= int32(exponentSign)
-		if s.TokenRecord.Token == T_INTEGER {
-			s.TokenRecord.TokenFloat = float64(s.TokenRecord.TokenInteger * int32(math.Pow(10, float64(evalue))))
-		} else {
-			s.TokenRecord.TokenFloat = s.TokenRecord.TokenFloat * float64(math.Pow(10.0, float64(evalue)))
-		}
+		floatString += fmt.Sprintf("e%d", evalue*int32(exponentSign))
+	}
+	if s.TokenRecord.Token == T_FLOAT {
+		s.TokenRecord.TokenFloat, _ = strconv.ParseFloat(floatString, 64)
 	}
 }
 
@@ -445,8 +477,7 @@ func (s *Scanner) getString(strEnd rune) {
 			}
 		}
 	}
-	fmt.Println("string without terminating quotation mark")
-	os.Exit(1)
+	s.error(ErrUnterminatedString, "string without terminating quotation mark")
 }
 
 func (s *Scanner) getSpecial() {
@@ -479,6 +510,9 @@ func (s *Scanner) getSpecial() {
 		s.TokenRecord.Token = T_SEMICOLON
 	case rune(':'):
 		s.TokenRecord.Token = T_COLON
+	case rune('.'): // the scanner only gets here with '..'
+		s.ch = s.nextChar()
+		s.TokenRecord.Token = T_DOTDOT
 	case rune('<'):
 		if s.StreamReader.Peek() == rune('=') {
 			s.ch = s.nextChar()
@@ -498,8 +532,8 @@ func (s *Scanner) getSpecial() {
 			s.ch = s.nextChar()
 			s.TokenRecord.Token = T_NOT_EQ
 		} else {
-			fmt.Printf("unexpecting '=' character after explanation point:%v\n", s.ch)
-			os.Exit(1)
+			s.ch = s.nextChar()
+			s.error(ErrUnexpectedCharacter, "expecting '=' character after exclamation point")
 		}
 	case rune('='):
 		if s.StreamReader.Peek() == rune('=') {
@@ -509,12 +543,82 @@ func (s *Scanner) getSpecial() {
 			s.TokenRecord.Token = T_ASSIGN
 		}
 	default:
-		fmt.Printf("unrecognized character in source code: %c\n", s.ch)
-		os.Exit(1)
+		ch := s.ch
+		s.ch = s.nextChar()
+		s.error(ErrUnexpectedCharacter, "unrecognized character in source code: %c", ch)
 	}
 	s.ch = s.nextChar()
 }
 
+// TokenSpelling returns how a keyword or special token is written in the source code
+func TokenSpelling(tokenCode TokenCode) string {
+	if tokenCode == T_ELSEIF {
+		return "elseif" // not elif, its synonym
+	}
+	for keyword, code := range keywords {
+		if code == tokenCode {
+			return keyword
+		}
+	}
+	switch tokenCode {
+	case T_EOF:
+		return "end of stream"
+	case T_STRING:
+		return "string"
+	case T_IDENT:
+		return "identifier"
+	case T_INTEGER:
+		return "integer"
+	case T_FLOAT:
+		return "float"
+	case T_PLUS:
+		return "+"
+	case T_MINUS:
+		return "-"
+	case T_MULT:
+		return "*"
+	case T_DIVIDE:
+		return "/"
+	case T_LESS:
+		return "<"
+	case T_GREATER:
+		return ">"
+	case T_LESS_EQ:
+		return "<="
+	case T_GREATER_EQ:
+		return ">="
+	case T_EQUAL:
+		return "=="
+	case T_ASSIGN:
+		return "="
+	case T_NOT_EQ:
+		return "!="
+	case T_COLON:
+		return ":"
+	case T_DOTDOT:
+		return ".."
+	case T_SEMICOLON:
+		return ";"
+	case T_COMMA:
+		return ","
+	case T_POWER:
+		return "^"
+	case T_LPAREN:
+		return "("
+	case T_RPAREN:
+		return ")"
+	case T_LBRACKET:
+		return "["
+	case T_RBRACKET:
+		return "]"
+	case T_LBRACE:
+		return "{"
+	case T_RBRACE:
+		return "}"
+	}
+	return "unknown token"
+}
+
 // debug function
 func (s *Scanner) TokenToString(tokenCode TokenCode) string {
 	switch tokenCode {
@@ -568,6 +672,8 @@ func (s *Scanner) TokenToString(tokenCode TokenCode) string {
 		return fmt.Sprintf("special <'%s'>", ";")
 	case T_COLON:
 		return fmt.Sprintf("special <'%s'>", ":")
+	case T_DOTDOT:
+		return fmt.Sprintf("special <'%s'>", "..")
 	case T_BREAK:
 		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
 	case T_IF:
@@ -576,6 +682,8 @@ func (s *Scanner) TokenToString(tokenCode TokenCode) string {
 		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
 	case T_ELSE:
 		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
+	case T_ELSEIF:
+		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
 	case T_THEN:
 		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
 	case T_END:
@@ -614,6 +722,18 @@ func (s *Scanner) TokenToString(tokenCode TokenCode) string {
 		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
 	case T_PRINTLN:
 		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
+	case T_IN:
+		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
+	case T_STEP:
+		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
+	case T_CONTINUE:
+		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
+	case T_SWITCH:
+		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
+	case T_CASE:
+		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
+	case T_GLOBAL:
+		return fmt.Sprintf("key word: <'%s'>", s.TokenRecord.TokenString)
 	}
 	return fmt.Sprint("end of stream: <EOF>")
 }
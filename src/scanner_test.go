@@ -0,0 +1,15 @@
+package src
+
+import "testing"
+
+func TestTokenSpelling(t *testing.T) {
+	NewScanner() // fills the keywords
+	for i := 0; i < 20; i++ {
+		if spelling := TokenSpelling(T_ELSEIF); spelling != "elseif" {
+			t.Fatalf("TokenSpelling(T_ELSEIF) = %q", spelling)
+		}
+	}
+	if spelling := TokenSpelling(T_WHILE); spelling != "while" {
+		t.Errorf("TokenSpelling(T_WHILE) = %q", spelling)
+	}
+}
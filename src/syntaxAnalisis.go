@@ -1,12 +1,8 @@
 package src
 
-import (
-	"fmt"
-	"os"
-)
-
 type SyntaxAnalisis struct {
-	sc *Scanner
+	sc          *Scanner
+	diagnostics DiagnosticList
 }
 
 func NewSyntaxAnalisis(sc *Scanner) *SyntaxAnalisis {
@@ -16,314 +12,763 @@ func NewSyntaxAnalisis(sc *Scanner) *SyntaxAnalisis {
 	return sy
 }
 
+// position returns the source position of the current token
+func (sy *SyntaxAnalisis) position() TSourcePosition {
+	return TSourcePosition{
+		Line:   sy.sc.TokenRecord.LineNumber,
+		Column: sy.sc.TokenRecord.ColumnNumber,
+	}
+}
+
+// nextToken advances the scanner, text that does not form a token is
+// reported and skipped
+func (sy *SyntaxAnalisis) nextToken() {
+	for {
+		err := sy.sc.NextToken()
+		if err == nil {
+			return
+		}
+		sy.report(err.(*Diagnostic))
+	}
+}
+
+// tokenError returns a diagnostic at the position of the current token
+func (sy *SyntaxAnalisis) tokenError(code ErrorCode, format string, args ...interface{}) *Diagnostic {
+	diagnostic := newDiagnostic(code, sy.sc.TokenRecord.LineNumber, sy.sc.TokenRecord.ColumnNumber, format, args...)
+	diagnostic.File = sy.sc.FileName
+	return diagnostic
+}
+
+// error aborts the current statement with a diagnostic at the current token,
+// statementList recovers from it
+func (sy *SyntaxAnalisis) error(code ErrorCode, format string, args ...interface{}) {
+	panic(sy.tokenError(code, format, args...))
+}
+
+// report records a diagnostic, a second error at the same position is
+// usually a consequence of the first one and is dropped
+func (sy *SyntaxAnalisis) report(diagnostic *Diagnostic) {
+	if n := len(sy.diagnostics); n > 0 {
+		last := sy.diagnostics[n-1]
+		if last.Line == diagnostic.Line && last.Column == diagnostic.Column {
+			return
+		}
+	}
+	sy.diagnostics = append(sy.diagnostics, diagnostic)
+}
+
+// Diagnostics returns the errors found by the last call to Program
+func (sy *SyntaxAnalisis) Diagnostics() DiagnosticList {
+	return sy.diagnostics
+}
+
+// startOfStatement reports if the current token is a statement keyword
+func (sy *SyntaxAnalisis) startOfStatement() bool {
+	switch sy.sc.Token() {
+	case T_IF, T_SWITCH, T_FOR, T_WHILE, T_REPEAT, T_RETURN, T_BREAK, T_CONTINUE, T_GLOBAL, T_FUNCTION, T_PRINT, T_PRINTLN:
+		return true
+	}
+	return false
+}
+
+// synchronize skips tokens after a syntax error until a statement
+// separator, the end of a block or the start of a new statement
+func (sy *SyntaxAnalisis) synchronize() {
+	for sy.sc.Token() != T_SEMICOLON && !sy.endOfStatementList() && !sy.startOfStatement() {
+		sy.nextToken()
+	}
+}
+
+// recoverStatement parses a statement, on a syntax error the error is
+// recorded, the analysis is resynchronized and nil is returned
+func (sy *SyntaxAnalisis) recoverStatement() (statement TStatement) {
+	defer func() {
+		if r := recover(); r != nil {
+			diagnostic, ok := r.(*Diagnostic)
+			if !ok {
+				panic(r)
+			}
+			sy.report(diagnostic)
+			sy.synchronize()
+			statement = nil
+		}
+	}()
+	return sy.statement()
+}
+
+// endOfStatementList reports if the current token closes a statement list
+func (sy *SyntaxAnalisis) endOfStatementList() bool {
+	switch sy.sc.Token() {
+	case T_UNTIL, T_END, T_ELSE, T_ELSEIF, T_CASE, T_EOF:
+		return true
+	}
+	return false
+}
+
 // statementList ::= statement { ';' statement }
-func (sy *SyntaxAnalisis) statementList() {
-	sy.statement()
-	for sy.sc.Token() == T_SEMICOLON {
-		sy.expect(T_SEMICOLON)
-		if sy.sc.Token() == T_UNTIL || sy.sc.Token() == T_END || sy.sc.Token() == T_ELSE || sy.sc.Token() == T_EOF {
-			break
+// a missing ';' is reported and the analysis goes on with the next statement
+func (sy *SyntaxAnalisis) statementList() []TStatement {
+	statements := []TStatement{}
+	for !sy.endOfStatementList() {
+		statement := sy.recoverStatement()
+		if statement != nil {
+			statements = append(statements, statement)
+		}
+		if sy.sc.Token() == T_SEMICOLON {
+			sy.nextToken()
+		} else if statement != nil && !sy.endOfStatementList() {
+			sy.report(sy.tokenError(ErrUnexpectedToken, "expecting '%s', found %s",
+				TokenSpelling(T_SEMICOLON), sy.sc.TokenToString(sy.sc.Token())))
+			if sy.sc.Token() != T_IDENT && !sy.startOfStatement() {
+				sy.synchronize()
+				if sy.sc.Token() == T_SEMICOLON {
+					sy.nextToken()
+				}
+			}
 		}
-		sy.statement()
 	}
+	return statements
 }
 
-// statement ::= assignment | sorStatement | ifStatement | whileStatement | repeatStatement
-// 							| returnStatement | breakStatement | functionDef | printlnStatement | endOfStream
-func (sy *SyntaxAnalisis) statement() {
+// statement ::= assignment | forStatement | ifStatement | switchStatement | whileStatement | repeatStatement
+// 							| returnStatement | breakStatement | continueStatement | globalStatement | functionDef | printlnStatement | endOfStream
+func (sy *SyntaxAnalisis) statement() TStatement {
 	switch sy.sc.Token() {
 	case T_IDENT:
-		token1 := sy.sc.TokenRecord
-		sy.sc.NextToken()
-		token2 := sy.sc.TokenRecord
-		if token2.Token == T_ASSIGN {
-			sy.assignment()
-		} else if token2.Token == T_LPAREN {
-			sy.sc.PushBackToken(token1)
-			sy.sc.PushBackToken(token2)
-			sy.factor()
-		}
+		return sy.assignment()
 	case T_IF:
-		sy.ifStatement()
+		return sy.ifStatement()
+	case T_SWITCH:
+		return sy.switchStatement()
 	case T_FOR:
-		sy.forStatement()
+		return sy.forStatement()
 	case T_WHILE:
-		sy.whileStatement()
+		return sy.whileStatement()
 	case T_REPEAT:
-		sy.repeatStatement()
+		return sy.repeatStatement()
 	case T_RETURN:
-		sy.returnStatement()
+		return sy.returnStatement()
 	case T_BREAK:
-		sy.breakStatement()
+		return sy.breakStatement()
+	case T_CONTINUE:
+		return sy.continueStatement()
+	case T_GLOBAL:
+		return sy.globalStatement()
 	case T_FUNCTION:
-		sy.functionDef()
+		return sy.functionDef()
 	case T_PRINT, T_PRINTLN:
-		sy.printlnStatement()
+		return sy.printlnStatement()
 	default:
-		fmt.Println("expecting assignment, if, for, while or repeat statement")
-		os.Exit(1)
+		sy.error(ErrExpectingStatement, "expecting a statement, found %s", sy.sc.TokenToString(sy.sc.Token()))
 	}
+	return nil
 }
 
 // repeatStatement ::= 'repeat' statementList 'until' expression
-func (sy *SyntaxAnalisis) repeatStatement() {
-	sy.sc.NextToken() // skip T_REPEAT
-	sy.statementList()
+func (sy *SyntaxAnalisis) repeatStatement() TStatement {
+	node := &TRepeatStatement{TSourcePosition: sy.position()}
+	sy.nextToken() // skip T_REPEAT
+	node.Body = sy.statementList()
 	sy.expect(T_UNTIL)
-	sy.expression()
+	node.Condition = sy.expression()
+	return node
 }
 
 // whileStatement ::= 'while' expression 'do' statementList 'end'
-func (sy *SyntaxAnalisis) whileStatement() {
-	sy.sc.NextToken() // skip T_WHILE
-	sy.expression()
+func (sy *SyntaxAnalisis) whileStatement() TStatement {
+	node := &TWhileStatement{TSourcePosition: sy.position()}
+	sy.nextToken() // skip T_WHILE
+	node.Condition = sy.expression()
 	sy.expect(T_DO)
-	sy.statementList()
+	node.Body = sy.statementList()
 	sy.expect(T_END)
+	return node
 }
 
 // forStatement ::= 'for' identifier '=' expression
-// ('to' | 'downto' ) expression 'do' statementList 'end'
-func (sy *SyntaxAnalisis) forStatement() {
-	sy.sc.NextToken() // skip the T_FOR
+// ('to' | 'downto' ) expression [ 'step' expression ] 'do' statementList 'end' | forInStatement
+func (sy *SyntaxAnalisis) forStatement() TStatement {
+	node := &TForStatement{TSourcePosition: sy.position()}
+	sy.nextToken() // skip the T_FOR
+	node.Variable = sy.sc.TokenRecord.TokenString
 	sy.expect(T_IDENT)
+	if sy.sc.Token() == T_IN {
+		return sy.forInStatement(node)
+	}
 	sy.expect(T_ASSIGN)
-	sy.expression()
+	node.Start = sy.expression()
 	if sy.sc.Token() == T_TO || sy.sc.Token() == T_DOWNTO {
-		sy.expect(T_TO)
-		sy.expression()
+		node.Downto = sy.sc.Token() == T_DOWNTO
+		sy.nextToken() // skip T_TO or T_DOWNTO
+		node.Stop = sy.expression()
+		if sy.sc.Token() == T_STEP {
+			sy.nextToken() // skip T_STEP
+			node.Step = sy.expression()
+		}
 		sy.expect(T_DO)
-		sy.statementList()
+		node.Body = sy.statementList()
 		sy.expect(T_END)
 	} else {
-		fmt.Println("expecting 'to' or 'downto' in for loop.")
-		os.Exit(1)
+		sy.error(ErrUnexpectedToken, "expecting 'to' or 'downto' in for loop, found %s", sy.sc.TokenToString(sy.sc.Token()))
+	}
+	return node
+}
+
+// forInStatement ::= 'for' identifier 'in' expression [ '..' expression ] 'do' statementList 'end'
+// the range a..b includes both ends and is the same as a for loop from a to b
+func (sy *SyntaxAnalisis) forInStatement(node *TForStatement) TStatement {
+	sy.nextToken() // skip T_IN
+	collection := sy.expression()
+	if sy.sc.Token() == T_DOTDOT {
+		sy.nextToken() // skip T_DOTDOT
+		node.Start = collection
+		node.Stop = sy.expression()
+		sy.expect(T_DO)
+		node.Body = sy.statementList()
+		sy.expect(T_END)
+		return node
 	}
+	forIn := &TForInStatement{TSourcePosition: node.TSourcePosition, Variable: node.Variable, Collection: collection}
+	sy.expect(T_DO)
+	forIn.Body = sy.statementList()
+	sy.expect(T_END)
+	return forIn
 }
 
 // breakStatement ::= 'break'
-func (sy *SyntaxAnalisis) breakStatement() {
-	sy.sc.NextToken()
+func (sy *SyntaxAnalisis) breakStatement() TStatement {
+	node := &TBreakStatement{TSourcePosition: sy.position()}
+	sy.nextToken()
+	return node
+}
+
+// continueStatement ::= 'continue'
+func (sy *SyntaxAnalisis) continueStatement() TStatement {
+	node := &TContinueStatement{TSourcePosition: sy.position()}
+	sy.nextToken()
+	return node
 }
 
-// ifStatement ::= 'if' expression 'then' statementList
-func (sy *SyntaxAnalisis) ifStatement() {
-	sy.sc.NextToken() // skip T_IF
-	sy.expression()
+// globalStatement ::= 'global' identifier { ',' identifier }
+func (sy *SyntaxAnalisis) globalStatement() TStatement {
+	node := &TGlobalStatement{TSourcePosition: sy.position()}
+	for {
+		sy.nextToken() // skip T_GLOBAL or T_COMMA
+		node.Names = append(node.Names, sy.sc.TokenRecord.TokenString)
+		sy.expect(T_IDENT)
+		if sy.sc.Token() != T_COMMA {
+			return node
+		}
+	}
+}
+
+// ifStatement ::= 'if' expression 'then' statementList ifEnd
+func (sy *SyntaxAnalisis) ifStatement() TStatement {
+	node := &TIfStatement{TSourcePosition: sy.position()}
+	sy.nextToken() // skip T_IF or T_ELSEIF
+	node.Condition = sy.expression()
 	sy.expect(T_THEN)
-	sy.statementList()
-	sy.ifEnd()
+	node.Then = sy.statementList()
+	node.Else = sy.ifEnd()
+	return node
 }
 
-// ifEnd ::= 'end' | 'else' statementList 'end'
-func (sy *SyntaxAnalisis) ifEnd() {
-	if sy.sc.Token() == T_ELSE {
-		sy.sc.NextToken() // skip T_ELSE
-		sy.statementList()
+// ifEnd ::= 'end' | 'else' statementList 'end' | ( 'elseif' | 'elif' ) expression 'then' statementList ifEnd
+// an elseif is parsed as an if statement nested in the else part
+func (sy *SyntaxAnalisis) ifEnd() []TStatement {
+	var elseStatements []TStatement
+	if sy.sc.Token() == T_ELSEIF {
+		elseStatements = []TStatement{sy.ifStatement()}
+	} else if sy.sc.Token() == T_ELSE {
+		sy.nextToken() // skip T_ELSE
+		elseStatements = sy.statementList()
 		sy.expect(T_END)
 	} else {
 		sy.expect(T_END)
 	}
+	return elseStatements
+}
+
+// switchStatement ::= 'switch' expression caseClause { caseClause } [ 'else' statementList ] 'end'
+func (sy *SyntaxAnalisis) switchStatement() TStatement {
+	node := &TSwitchStatement{TSourcePosition: sy.position()}
+	sy.nextToken() // skip T_SWITCH
+	node.Subject = sy.expression()
+	if sy.sc.Token() != T_CASE {
+		sy.error(ErrUnexpectedToken, "expecting '%s' in switch statement, found %s", TokenSpelling(T_CASE), sy.sc.TokenToString(sy.sc.Token()))
+	}
+	for sy.sc.Token() == T_CASE {
+		node.Cases = append(node.Cases, sy.caseClause())
+	}
+	if sy.sc.Token() == T_ELSE {
+		sy.nextToken() // skip T_ELSE
+		node.Else = sy.statementList()
+	}
+	sy.expect(T_END)
+	return node
+}
+
+// caseClause ::= 'case' caseLabel { ',' caseLabel } ':' statementList
+func (sy *SyntaxAnalisis) caseClause() *TCaseClause {
+	node := &TCaseClause{TSourcePosition: sy.position()}
+	sy.nextToken() // skip T_CASE
+	node.Labels = append(node.Labels, sy.caseLabel())
+	for sy.sc.Token() == T_COMMA {
+		sy.nextToken() // skip T_COMMA
+		node.Labels = append(node.Labels, sy.caseLabel())
+	}
+	sy.expect(T_COLON)
+	node.Body = sy.statementList()
+	return node
 }
 
-// functionDef ::= 'function' identifier [ '(' argumentList ')' ]
-func (sy *SyntaxAnalisis) functionDef() {
-	sy.sc.NextToken() // skip T_FUNCTION
+// caseLabel ::= expression [ '..' expression ]
+func (sy *SyntaxAnalisis) caseLabel() *TCaseLabel {
+	node := &TCaseLabel{TSourcePosition: sy.position(), Low: sy.expression()}
+	if sy.sc.Token() == T_DOTDOT {
+		sy.nextToken() // skip T_DOTDOT
+		node.High = sy.expression()
+	}
+	return node
+}
+
+// functionDef ::= 'function' identifier [ '(' argumentList ')' ] statementList 'end'
+func (sy *SyntaxAnalisis) functionDef() TStatement {
+	node := &TFunctionDef{TSourcePosition: sy.position()}
+	sy.nextToken() // skip T_FUNCTION
+	node.Name = sy.sc.TokenRecord.TokenString
 	sy.expect(T_IDENT)
 	if sy.sc.Token() == T_LPAREN {
-		sy.sc.NextToken() // skip T_LPAREN
-		if sy.sc.Token() != T_RPAREN {
-			sy.argumentList()
-		}
-		sy.expect(T_RPAREN)
+		node.Parameters = sy.parameters()
 	}
-	sy.statementList()
+	node.Body = sy.statementList()
 	sy.expect(T_END)
+	return node
+}
+
+// functionExpression ::= 'function' '(' [ argumentList ] ')' statementList 'end'
+func (sy *SyntaxAnalisis) functionExpression() TExpression {
+	node := &TFunctionExpression{TSourcePosition: sy.position()}
+	sy.nextToken() // skip T_FUNCTION
+	node.Parameters = sy.parameters()
+	node.Body = sy.statementList()
+	sy.expect(T_END)
+	return node
+}
+
+// parameters ::= '(' [ argumentList ] ')'
+func (sy *SyntaxAnalisis) parameters() []TParameter {
+	var parameters []TParameter
+	sy.expect(T_LPAREN)
+	if sy.sc.Token() != T_RPAREN {
+		parameters = sy.argumentList()
+	}
+	sy.expect(T_RPAREN)
+	return parameters
 }
 
 // argumentList ::= argument { ',' argument }
-func (sy *SyntaxAnalisis) argumentList() {
-	sy.argument()
+func (sy *SyntaxAnalisis) argumentList() []TParameter {
+	arguments := []TParameter{sy.argument()}
 	for sy.sc.Token() == T_COMMA {
-		sy.sc.NextToken() // skip T_COMMA
-		sy.argument()
+		if arguments[len(arguments)-1].IsVariadic {
+			sy.report(sy.tokenError(ErrUnexpectedToken, "the variadic parameter '%s' must be the last one", arguments[len(arguments)-1].Name))
+		}
+		sy.nextToken() // skip T_COMMA
+		arguments = append(arguments, sy.argument())
 	}
+	return arguments
 }
 
-// argument ::= ['ref'] identifier
-func (sy *SyntaxAnalisis) argument() {
+// argument ::= ['ref'] identifier ['=' expression] | '*' identifier
+func (sy *SyntaxAnalisis) argument() TParameter {
+	argument := TParameter{TSourcePosition: sy.position()}
+	if sy.sc.Token() == T_MULT {
+		argument.IsVariadic = true
+		sy.nextToken() // skip T_MULT
+		argument.Name = sy.sc.TokenRecord.TokenString
+		sy.expect(T_IDENT)
+		return argument
+	}
 	if sy.sc.Token() == T_REF {
-		sy.sc.NextToken() // skip T_REF
+		argument.IsRef = true
+		sy.nextToken() // skip T_REF
 	}
+	argument.Name = sy.sc.TokenRecord.TokenString
 	sy.expect(T_IDENT)
+	if sy.sc.Token() == T_ASSIGN {
+		sy.nextToken() // skip T_ASSIGN
+		argument.Default = sy.expression()
+	}
+	return argument
+}
+
+// relationalOp ::= '<' | '<=' | '>' | '>=' | '==' | '!=' | 'in'
+func (sy *SyntaxAnalisis) relationalOp() bool {
+	return sy.sc.Token() == T_LESS || sy.sc.Token() == T_LESS_EQ || sy.sc.Token() == T_GREATER ||
+		sy.sc.Token() == T_GREATER_EQ || sy.sc.Token() == T_EQUAL || sy.sc.Token() == T_NOT_EQ || sy.sc.Token() == T_IN
 }
 
-// expression ::= simpleExpression | simpreExpression relationalOp simpleExpression
-func (sy *SyntaxAnalisis) expression() {
-	sy.simpleExpression()
-	if sy.sc.Token() == T_LESS || sy.sc.Token() == T_LESS_EQ || sy.sc.Token() == T_GREATER ||
-		sy.sc.Token() == T_GREATER_EQ || sy.sc.Token() == T_EQUAL || sy.sc.Token() == T_NOT_EQ {
-		sy.sc.NextToken() // skip matched token
-		sy.expression()
+// expression ::= andExpression { ( 'or' | 'xor' ) andExpression }
+func (sy *SyntaxAnalisis) expression() TExpression {
+	left := sy.andExpression()
+	for sy.sc.Token() == T_OR || sy.sc.Token() == T_XOR {
+		node := &TBinaryExpression{TSourcePosition: sy.position(), Operator: sy.sc.Token(), Left: left}
+		sy.nextToken() // skip T_OR or T_XOR
+		node.Right = sy.andExpression()
+		left = node
 	}
+	return left
+}
+
+// andExpression ::= notExpression { 'and' notExpression }
+func (sy *SyntaxAnalisis) andExpression() TExpression {
+	left := sy.notExpression()
+	for sy.sc.Token() == T_AND {
+		node := &TBinaryExpression{TSourcePosition: sy.position(), Operator: T_AND, Left: left}
+		sy.nextToken() // skip T_AND
+		node.Right = sy.notExpression()
+		left = node
+	}
+	return left
+}
+
+// notExpression ::= 'not' notExpression | relOpExpression
+func (sy *SyntaxAnalisis) notExpression() TExpression {
+	if sy.sc.Token() == T_NOT {
+		pos := sy.position()
+		sy.nextToken() // skip T_NOT
+		return &TUnaryExpression{TSourcePosition: pos, Operator: T_NOT, Operand: sy.notExpression()}
+	}
+	return sy.relOpExpression()
+}
+
+// relOpExpression ::= simpleExpression [ relationalOp simpleExpression ]
+// relational operators do not chain, a < b < c is an error
+func (sy *SyntaxAnalisis) relOpExpression() TExpression {
+	left := sy.simpleExpression()
+	if sy.relationalOp() {
+		node := &TBinaryExpression{TSourcePosition: sy.position(), Operator: sy.sc.Token(), Left: left}
+		sy.nextToken() // skip matched token
+		node.Right = sy.simpleExpression()
+		if sy.relationalOp() {
+			sy.error(ErrChainedComparison, "comparisons cannot be chained, write a %s b and b %s c",
+				TokenSpelling(node.Operator), TokenSpelling(sy.sc.Token()))
+		}
+		return node
+	}
+	return left
 }
 
 // simpleExpression ::= term { addingOp term }
-func (sy *SyntaxAnalisis) simpleExpression() {
-	sy.term()
+func (sy *SyntaxAnalisis) simpleExpression() TExpression {
+	left := sy.term()
 	for sy.addingOp() {
-		sy.sc.NextToken()
-		sy.term()
+		node := &TBinaryExpression{TSourcePosition: sy.position(), Operator: sy.sc.Token(), Left: left}
+		sy.nextToken()
+		node.Right = sy.term()
+		left = node
 	}
+	return left
 }
 
-// factor ::= '(' expression ')' | number | variable
-func (sy *SyntaxAnalisis) factor() {
+// factor ::= '(' expression ')' | number | string | variable | 'True' | 'False' | list | map | functionExpression
+func (sy *SyntaxAnalisis) factor() TExpression {
+	pos := sy.position()
 	switch sy.sc.Token() {
 	case T_INTEGER:
-		sy.sc.NextToken()
+		node := &TIntegerLiteral{TSourcePosition: pos, Value: int(sy.sc.TokenRecord.TokenInteger)}
+		sy.nextToken()
+		return node
 	case T_FLOAT:
-		sy.sc.NextToken()
+		node := &TFloatLiteral{TSourcePosition: pos, Value: sy.sc.TokenRecord.TokenFloat}
+		sy.nextToken()
+		return node
 	case T_IDENT:
-		sy.expect(T_IDENT)
+		return sy.variable()
+	case T_FUNCTION:
+		return sy.functionExpression()
+	case T_LPAREN:
+		sy.nextToken()
+		node := sy.expression()
+		sy.expect(T_RPAREN)
+		return node
+	case T_STRING:
+		node := &TStringLiteral{TSourcePosition: pos, Value: sy.sc.TokenRecord.TokenString}
+		sy.nextToken() // skip T_STRING
+		return node
+	case T_FALSE:
+		sy.nextToken()
+		return &TBooleanLiteral{TSourcePosition: pos, Value: false}
+	case T_TRUE:
+		sy.nextToken()
+		return &TBooleanLiteral{TSourcePosition: pos, Value: true}
+	case T_LBRACE: // list ::= '{' [ doList ] '}', ie: {"1", 2, True, False, etc}
+		sy.nextToken() // skip T_LBRACE
+		if sy.sc.Token() == T_COLON { // the empty map {:}
+			sy.nextToken() // skip T_COLON
+			sy.expect(T_RBRACE)
+			return &TMapLiteral{TSourcePosition: pos}
+		}
+		node := &TListLiteral{TSourcePosition: pos}
+		if sy.sc.Token() != T_RBRACE {
+			node.Elements = sy.doList()
+			if len(node.Elements) == 1 && sy.sc.Token() == T_COLON {
+				return sy.mapLiteral(pos, node.Elements[0])
+			}
+		}
+		sy.expect(T_RBRACE)
+		return node
+	default:
+		sy.error(ErrExpectingFactor, "expecting scalar, identifier or left parentheses, found %s", sy.sc.TokenToString(sy.sc.Token()))
+	}
+	return nil
+}
+
+// variable ::= identifier { '[' subscriptList ']' | '(' [ expressionList ] ')' }
+func (sy *SyntaxAnalisis) variable() TExpression {
+	var node TExpression = &TIdentifier{TSourcePosition: sy.position(), Name: sy.sc.TokenRecord.TokenString}
+	sy.expect(T_IDENT)
+	for {
+		pos := sy.position()
 		if sy.sc.Token() == T_LBRACKET { // index assignment or expression
-			sy.sc.NextToken() // skip the T_LBRACKET
+			sy.nextToken() // skip the T_LBRACKET
+			index := &TIndexExpression{TSourcePosition: pos, Target: node}
 			if sy.sc.Token() != T_RBRACKET {
-				sy.expressionList()
+				index.Indices = sy.subscriptList()
 			}
 			sy.expect(T_RBRACKET)
+			node = index
 		} else if sy.sc.Token() == T_LPAREN { // function call
 			sy.expect(T_LPAREN)
+			call := &TCallExpression{TSourcePosition: pos, Function: node}
 			if sy.sc.Token() != T_RPAREN {
-				sy.expressionList()
+				sy.callArguments(call)
 			}
 			sy.expect(T_RPAREN)
+			node = call
+		} else {
+			return node
 		}
-	case T_LPAREN:
-		sy.sc.NextToken()
-		sy.expression()
-		sy.expect(T_RPAREN)
-	case T_STRING:
-		sy.sc.NextToken() // skip T_STRING
-	case T_NOT: // not booleanExpression
-		sy.sc.NextToken()
-		sy.expression()
-	case T_FALSE:
-		sy.sc.NextToken()
-	case T_TRUE:
-		sy.sc.NextToken()
-	case T_LBRACE: // lists: {"1", 2, True, False, etc}
-		sy.sc.NextToken() // skip T_LBRACE
-		if sy.sc.Token() != T_RBRACE {
-			sy.doList()
+	}
+}
+
+// callArguments ::= callArgument { ',' callArgument }
+// callArgument ::= [ identifier '=' ] expression
+// the arguments given by name follow the ones given by position
+func (sy *SyntaxAnalisis) callArguments(call *TCallExpression) {
+	for {
+		argument := sy.expression()
+		if sy.sc.Token() == T_ASSIGN {
+			identifier, ok := argument.(*TIdentifier)
+			if !ok {
+				sy.error(ErrUnexpectedToken, "the name of an argument must be an identifier")
+			}
+			sy.nextToken() // skip T_ASSIGN
+			call.Names = append(call.Names, identifier.Name)
+			argument = sy.expression()
+		} else if len(call.Names) > 0 {
+			sy.error(ErrUnexpectedToken, "an argument given by position cannot follow one given by name")
+		}
+		call.Arguments = append(call.Arguments, argument)
+		if sy.sc.Token() != T_COMMA {
+			return
+		}
+		sy.nextToken() // skip T_COMMA
+	}
+}
+
+// subscriptList ::= subscript { ',' subscript }
+func (sy *SyntaxAnalisis) subscriptList() []TExpression {
+	subscripts := []TExpression{sy.subscript()}
+	for sy.sc.Token() == T_COMMA {
+		sy.nextToken() // skip T_COMMA
+		subscripts = append(subscripts, sy.subscript())
+	}
+	return subscripts
+}
+
+// subscript ::= expression | [ expression ] ':' [ expression ]
+func (sy *SyntaxAnalisis) subscript() TExpression {
+	pos := sy.position()
+	var low TExpression
+	if sy.sc.Token() != T_COLON {
+		low = sy.expression()
+		if sy.sc.Token() != T_COLON {
+			return low
 		}
-		sy.expect(T_RBRACE)
-	default:
-		fmt.Println("expecting scalar, identifier or left parentheses")
 	}
+	sy.nextToken() // skip T_COLON
+	slice := &TSliceExpression{TSourcePosition: pos, Low: low}
+	if sy.sc.Token() != T_COMMA && sy.sc.Token() != T_RBRACKET {
+		slice.High = sy.expression()
+	}
+	return slice
 }
 
 // doList ::= expression {',' expression}
-func (sy *SyntaxAnalisis) doList() {
-	sy.expression()
+func (sy *SyntaxAnalisis) doList() []TExpression {
+	elements := []TExpression{sy.expression()}
 	for sy.sc.Token() == T_COMMA {
-		sy.sc.NextToken()
-		sy.expression()
+		sy.nextToken()
+		elements = append(elements, sy.expression())
+	}
+	return elements
+}
+
+// map ::= '{' expression ':' expression { ',' expression ':' expression } '}' | '{' ':' '}'
+// mapLiteral is called after the first key
+func (sy *SyntaxAnalisis) mapLiteral(pos TSourcePosition, key TExpression) TExpression {
+	node := &TMapLiteral{TSourcePosition: pos}
+	for {
+		sy.expect(T_COLON)
+		node.Keys = append(node.Keys, key)
+		node.Values = append(node.Values, sy.expression())
+		if sy.sc.Token() != T_COMMA {
+			break
+		}
+		sy.nextToken() // skip T_COMMA
+		key = sy.expression()
 	}
+	sy.expect(T_RBRACE)
+	return node
 }
 
 // term ::= power { multiplyOp power }
-func (sy *SyntaxAnalisis) term() {
-	sy.power()
+func (sy *SyntaxAnalisis) term() TExpression {
+	left := sy.power()
 	for sy.multiplyOp() {
-		sy.sc.NextToken()
-		sy.power()
+		node := &TBinaryExpression{TSourcePosition: sy.position(), Operator: sy.sc.Token(), Left: left}
+		sy.nextToken()
+		node.Right = sy.power()
+		left = node
 	}
+	return left
 }
 
 // power ::= {'+'|'-'} factor ['^' power]
-func (sy *SyntaxAnalisis) power() {
+// '^' is right associative and binds tighter than the sign: -2^2 is -(2^2)
+func (sy *SyntaxAnalisis) power() TExpression {
+	pos := sy.position()
 	sign := float64(1)
 
 	for sy.sc.Token() == T_PLUS || sy.sc.Token() == T_MINUS {
 		if sy.sc.Token() == T_MINUS {
 			sign = sign * -1
-			sy.sc.NextToken() // eat T_MINUS
+			sy.nextToken() // eat T_MINUS
 		} else {
-			sy.sc.NextToken()
+			sy.nextToken()
 		}
 	}
 
-	sy.factor()
+	node := sy.factor()
 	if sy.sc.Token() == T_POWER {
-		sy.sc.NextToken()
-		sy.factor()
+		powerNode := &TBinaryExpression{TSourcePosition: sy.position(), Operator: T_POWER, Left: node}
+		sy.nextToken()
+		powerNode.Right = sy.power()
+		node = powerNode
+	}
+	if sign < 0 {
+		node = &TUnaryExpression{TSourcePosition: pos, Operator: T_MINUS, Operand: node}
 	}
+	return node
 }
 
-// assignment ::= variable '=' expression
-func (sy *SyntaxAnalisis) assignment() {
-	sy.expect(T_IDENT)
-	if sy.sc.Token() == T_LBRACKET {
-		sy.sc.NextToken() // skip '['
-		sy.expressionList()
-		sy.expect(T_RBRACKET)
+// assignment ::= variable { ',' variable } '=' expressionList | functionCall
+func (sy *SyntaxAnalisis) assignment() TStatement {
+	pos := sy.position()
+	target := sy.variable()
+	if call, ok := target.(*TCallExpression); ok && sy.sc.Token() != T_ASSIGN && sy.sc.Token() != T_COMMA {
+		return &TExpressionStatement{TSourcePosition: pos, Expression: call}
+	}
+	targets := []TExpression{sy.assignmentTarget(target)}
+	for sy.sc.Token() == T_COMMA {
+		sy.nextToken() // skip T_COMMA
+		targets = append(targets, sy.assignmentTarget(sy.variable()))
 	}
 	sy.expect(T_ASSIGN)
-	sy.expression()
+	values := sy.expressionList()
+	if len(targets) == 1 && len(values) == 1 {
+		return &TAssignment{TSourcePosition: pos, Target: target, Value: values[0]}
+	}
+	return &TMultipleAssignment{TSourcePosition: pos, Targets: targets, Values: values}
 }
 
-// addingOp ::= '+' | '-' | or | xor
+func (sy *SyntaxAnalisis) assignmentTarget(target TExpression) TExpression {
+	if _, ok := target.(*TCallExpression); ok {
+		sy.error(ErrInvalidAssignment, "left-hand side of the assignment must be a variable")
+	}
+	return target
+}
+
+// addingOp ::= '+' | '-'
 func (sy *SyntaxAnalisis) addingOp() bool {
-	addOp := sy.sc.Token() == T_PLUS || sy.sc.Token() == T_MINUS
-	logicalOp := sy.sc.Token() == T_OR || sy.sc.Token() == T_XOR
-	return addOp || logicalOp
+	return sy.sc.Token() == T_PLUS || sy.sc.Token() == T_MINUS
 }
 
-// multiplyOp ::= '*' | '/' | and | mod | div
+// multiplyOp ::= '*' | '/' | mod | div
 func (sy *SyntaxAnalisis) multiplyOp() bool {
-	multOp := sy.sc.Token() == T_MULT || sy.sc.Token() == T_DIVIDE
-	logicalOp := sy.sc.Token() == T_AND || sy.sc.Token() == T_MOD || sy.sc.Token() == T_DIV
-
-	return multOp || logicalOp
+	return sy.sc.Token() == T_MULT || sy.sc.Token() == T_DIVIDE || sy.sc.Token() == T_MOD || sy.sc.Token() == T_DIV
 }
 
 // expressionList ::= expression { ',' expression }
-func (sy *SyntaxAnalisis) expressionList() {
-	sy.expression()
+func (sy *SyntaxAnalisis) expressionList() []TExpression {
+	expressions := []TExpression{sy.expression()}
 	for sy.sc.Token() == T_COMMA {
 		sy.expect(T_COMMA)
-		sy.expression()
+		expressions = append(expressions, sy.expression())
 	}
+	return expressions
 }
 
-// returnStatement ::= 'return' expression
-func (sy *SyntaxAnalisis) returnStatement() {
-	sy.sc.NextToken() // skip T_RETURN
-	sy.expression()
+// returnStatement ::= 'return' [ expressionList ]
+func (sy *SyntaxAnalisis) returnStatement() TStatement {
+	node := &TReturnStatement{TSourcePosition: sy.position()}
+	sy.nextToken() // skip T_RETURN
+	if sy.sc.Token() != T_SEMICOLON && !sy.endOfStatementList() {
+		node.Values = sy.expressionList()
+	}
+	return node
 }
 
-// printlnStatement ::= 'println' '(' expression ')'
-func (sy *SyntaxAnalisis) printlnStatement() {
-	sy.sc.NextToken() // skip T_PRINT, T_PRINTLN
+// printlnStatement ::= ('print' | 'println') '(' [ expressionList ] ')'
+func (sy *SyntaxAnalisis) printlnStatement() TStatement {
+	node := &TPrintStatement{TSourcePosition: sy.position(), NewLine: sy.sc.Token() == T_PRINTLN}
+	sy.nextToken() // skip T_PRINT, T_PRINTLN
 	sy.expect(T_LPAREN)
-	sy.expression()
+	if sy.sc.Token() != T_RPAREN {
+		node.Arguments = sy.expressionList()
+	}
 	sy.expect(T_RPAREN)
+	return node
 }
 
-// program ::= assignment | outputStatement
-func (sy *SyntaxAnalisis) Program() {
-	sy.statementList()
-	if sy.sc.Token() != T_EOF {
-		sy.expect(T_SEMICOLON)
+// program ::= statementList
+// the scanner must be positioned on the first token. The analysis goes on
+// after a syntax error, all the errors found are returned in a DiagnosticList
+func (sy *SyntaxAnalisis) Program() (*TASTProgram, error) {
+	sy.diagnostics = nil
+	program := &TASTProgram{TSourcePosition: sy.position()}
+	program.Statements = sy.statementList()
+	for sy.sc.Token() != T_EOF {
+		// 'end', 'until' or 'else' without an enclosing block
+		sy.report(sy.tokenError(ErrUnexpectedToken, "unexpected %s", sy.sc.TokenToString(sy.sc.Token())))
+		sy.nextToken()
+		if sy.sc.Token() == T_SEMICOLON {
+			sy.nextToken()
+		}
+		program.Statements = append(program.Statements, sy.statementList()...)
+	}
+	if len(sy.diagnostics) > 0 {
+		return program, sy.diagnostics
 	}
+	return program, nil
 }
 
 func (sy *SyntaxAnalisis) expect(tokenCode TokenCode) {
 	if tokenCode == sy.sc.getTokenCode() {
-		sy.sc.NextToken()
+		sy.nextToken()
 	} else {
-		fmt.Printf("expecting:%s\n", sy.sc.TokenToString(tokenCode))
-		os.Exit(1)
+		sy.error(ErrUnexpectedToken, "expecting '%s', found %s", TokenSpelling(tokenCode), sy.sc.TokenToString(sy.sc.Token()))
 	}
 }
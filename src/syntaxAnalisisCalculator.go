@@ -3,7 +3,6 @@ package src
 import (
 	"fmt"
 	"math"
-	"os"
 )
 
 type SyntaxAnalisisCalc struct {
@@ -21,15 +20,27 @@ func NewSyntaxAnalisisCalc(sc *Scanner) *SyntaxAnalisisCalc {
 	return sy
 }
 
+func (sy *SyntaxAnalisisCalc) nextToken() {
+	if err := sy.sc.NextToken(); err != nil {
+		panic(err)
+	}
+}
+
+func (sy *SyntaxAnalisisCalc) error(code ErrorCode, format string, args ...interface{}) {
+	diagnostic := newDiagnostic(code, sy.sc.TokenRecord.LineNumber, sy.sc.TokenRecord.ColumnNumber, format, args...)
+	diagnostic.File = sy.sc.FileName
+	panic(diagnostic)
+}
+
 // expression ::= term { ('+' | '-') term }
 func (sy *SyntaxAnalisisCalc) expression() float64 {
 	result := sy.term()
 	for sy.sc.Token() == T_PLUS || sy.sc.Token() == T_MINUS {
 		if sy.sc.Token() == T_PLUS {
-			sy.sc.NextToken()
+			sy.nextToken()
 			result += sy.term()
 		} else {
-			sy.sc.NextToken()
+			sy.nextToken()
 			result -= sy.term()
 		}
 	}
@@ -40,31 +51,32 @@ func (sy *SyntaxAnalisisCalc) expression() float64 {
 func (sy *SyntaxAnalisisCalc) factor() float64 {
 	switch sy.sc.Token() {
 	case T_INTEGER:
-		sy.sc.NextToken()
-		return float64(sy.sc.TokenRecord.TokenInteger)
+		value := float64(sy.sc.TokenRecord.TokenInteger)
+		sy.nextToken()
+		return value
 	case T_FLOAT:
-		sy.sc.NextToken()
-		return sy.sc.TokenRecord.TokenFloat
+		value := sy.sc.TokenRecord.TokenFloat
+		sy.nextToken()
+		return value
 	case T_LPAREN:
-		sy.sc.NextToken()
+		sy.nextToken()
 		result := sy.expression()
 		sy.expect(T_RPAREN)
 		return result
 	case T_IDENT:
 		return sy.getIdentifierValue(sy.sc.TokenRecord.TokenString)
 	default:
-		fmt.Println("expecting identifier, scalar or left parentheses")
+		sy.error(ErrExpectingFactor, "expecting identifier, scalar or left parentheses")
 	}
 	return 0
 }
 
 func (sy *SyntaxAnalisisCalc) getIdentifierValue(name string) float64 {
-	sy.sc.NextToken() // skip T_ASSIGN
+	sy.nextToken() // skip T_ASSIGN
 	if symbol, ok := sy.symbolTable[name]; ok {
 		return symbol
 	}
-	fmt.Printf("symbol: '%s' has no assigned value\n", name)
-	os.Exit(1)
+	sy.error(ErrUndefinedVariable, "symbol: '%s' has no assigned value", name)
 	return 0
 }
 
@@ -72,8 +84,7 @@ func (sy *SyntaxAnalisisCalc) getIdentifierValue(name string) float64 {
 func (sy *SyntaxAnalisisCalc) assignment(variableName string) {
 	value := sy.expression()
 	if variableName == "pi" {
-		fmt.Printf("pi is a built-in constant, you cannot redefine it.\n")
-		return
+		sy.error(ErrInvalidAssignment, "pi is a built-in constant, you cannot redefine it")
 	}
 	sy.symbolTable[variableName] = value
 }
@@ -83,10 +94,10 @@ func (sy *SyntaxAnalisisCalc) term() float64 {
 	result := sy.power()
 	for sy.sc.Token() == T_MULT || sy.sc.Token() == T_DIVIDE {
 		if sy.sc.Token() == T_MULT {
-			sy.sc.NextToken() // eat T_MULT
+			sy.nextToken() // eat T_MULT
 			result *= sy.power()
 		} else {
-			sy.sc.NextToken() // eat T_DIVIDE
+			sy.nextToken() // eat T_DIVIDE
 			result /= sy.power()
 		}
 	}
@@ -94,21 +105,22 @@ func (sy *SyntaxAnalisisCalc) term() float64 {
 }
 
 // power ::= {'+'|'-'} factor ['^' power]
+// '^' is right associative and binds tighter than the sign: -2^2 is -(2^2)
 func (sy *SyntaxAnalisisCalc) power() float64 {
 	sign := float64(1)
 
 	for sy.sc.Token() == T_PLUS || sy.sc.Token() == T_MINUS {
 		if sy.sc.Token() == T_MINUS {
 			sign = sign * -1
-			sy.sc.NextToken() // eat T_MINUS
+			sy.nextToken() // eat T_MINUS
 		} else {
-			sy.sc.NextToken()
+			sy.nextToken()
 		}
 	}
 
 	result := sy.factor()
 	if sy.sc.Token() == T_POWER {
-		sy.sc.NextToken()
+		sy.nextToken()
 		result = math.Pow(result, sy.power())
 	}
 	return sign * result
@@ -116,32 +128,32 @@ func (sy *SyntaxAnalisisCalc) power() float64 {
 
 func (sy *SyntaxAnalisisCalc) expect(tokenCode TokenCode) {
 	if tokenCode == sy.sc.Token() {
-		sy.sc.NextToken()
+		sy.nextToken()
 	} else {
-		fmt.Printf("expecting:%s\n", sy.sc.TokenToString(tokenCode))
-		os.Exit(1)
+		sy.error(ErrUnexpectedToken, "expecting '%s', found %s", TokenSpelling(tokenCode), sy.sc.TokenToString(sy.sc.Token()))
 	}
 }
 
 // statement = assignment | expression
-func (sy *SyntaxAnalisisCalc) Statement() {
-	sy.sc.NextToken() // start the scanner
+func (sy *SyntaxAnalisisCalc) Statement() (err error) {
+	defer recoverDiagnostic(&err)
+	sy.nextToken() // start the scanner
 	token1 := sy.sc.TokenRecord
-	sy.sc.NextToken()
+	sy.nextToken()
 	token2 := sy.sc.TokenRecord
 
 	if sy.sc.Token() == T_ASSIGN {
 		if token1.Token == T_IDENT {
-			sy.sc.NextToken()
+			sy.nextToken()
 			sy.assignment(token1.TokenString)
 		} else {
-			fmt.Printf("left-hand side of the assignment must be a variable")
-			os.Exit(1)
+			sy.error(ErrInvalidAssignment, "left-hand side of the assignment must be a variable")
 		}
 	} else {
 		sy.sc.PushBackToken(token1)
 		sy.sc.PushBackToken(token2)
-		sy.sc.NextToken()
+		sy.nextToken()
 		fmt.Println(sy.expression())
 	}
+	return nil
 }
@@ -0,0 +1,27 @@
+package src
+
+import "testing"
+
+func TestCalculatorExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		value      float64
+	}{
+		{`7`, 7},
+		{`2.5 * 4`, 10},
+		{`-2^2`, -4},
+		{`2^3^2`, 512},
+		{`(1 + 2) * -3 - 4 / 8`, -9.5},
+		{`2 * pi`, 6.28318530717958},
+	}
+	for _, test := range tests {
+		sc := NewScanner()
+		sc.ScanString(test.expression)
+		if err := sc.NextToken(); err != nil {
+			t.Fatal(err)
+		}
+		if value := NewSyntaxAnalisisCalc(sc).expression(); value != test.value {
+			t.Errorf("%s: expecting %v, found %v", test.expression, test.value, value)
+		}
+	}
+}
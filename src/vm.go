@@ -2,40 +2,159 @@ package src
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strings"
 )
 
+const (
+	DEFAULT_STACK_SIZE     = 65536
+	DEFAULT_MAX_CALL_DEPTH = 1000
+)
+
+// TCallFrame saves the state of the caller while a Rhodus function runs
+type TCallFrame struct {
+	function *TFunctionObject
+	code     TProgram // code of the caller
+	ip       int      // index of the oCall instruction in the caller
+	base     int      // stack index of the first local of the caller
+	// the caller accepts several values, otherwise returning them is an error
+	multipleValues bool
+}
+
 type VM struct {
-	stack     TMachineStack
-	stackTop  int
-	stackSize int
-	module    *Module
+	stack        TMachineStack
+	stackTop     int
+	stackSize    int
+	module       *Module
+	code         TProgram // code being executed
+	ip           int      // index of the instruction being executed
+	base         int      // stack index of the first local of the running function
+	frames       []TCallFrame
+	maxCallDepth int
+	// set by oMultipleValues for the next call
+	multipleValues bool
+	stdout         io.Writer
 }
 
 func NewVM(stackSize int) *VM {
 	vm := &VM{
-		stackSize: stackSize,
-		module:    NewModule(),
+		module:       NewModule(),
+		maxCallDepth: DEFAULT_MAX_CALL_DEPTH,
+		stdout:       os.Stdout,
 	}
+	vm.createStack(stackSize)
 	return vm
 }
 
 func (vm *VM) createStack(size int) {
+	vm.stack = make(TMachineStack, size)
 	vm.stackSize = size
 	vm.stackTop = -1
 }
 
-func (vm *VM) RunModule(module *Module) {
+// SetMaxCallDepth sets the number of nested function calls allowed before
+// the execution stops with a stack overflow error
+func (vm *VM) SetMaxCallDepth(depth int) {
+	vm.maxCallDepth = depth
+}
+
+// RunModule executes the module code, runtime errors stop the execution
+// and are returned as a *Diagnostic
+func (vm *VM) RunModule(module *Module) (err error) {
+	defer recoverDiagnostic(&err)
 	vm.module = module
+	vm.stackTop = -1
+	vm.base = 0
+	vm.frames = vm.frames[:0]
 	vm.run(vm.module.Code)
+	return nil
+}
+
+// runtimeError stops the execution with a diagnostic at the line of the
+// instruction being executed
+func (vm *VM) runtimeError(code ErrorCode, format string, args ...interface{}) {
+	diagnostic := newDiagnostic(code, vm.code[vm.ip].line, 0, format, args...)
+	diagnostic.File = vm.module.Name
+	panic(diagnostic)
 }
 
 func (vm *VM) run(code TProgram) {
-	ip := 0
+	vm.code = code
+	vm.ip = 0
 	for {
-		switch code[ip].OpCode {
+		instruction := vm.code[vm.ip]
+		switch instruction.OpCode {
 		case oPushi:
-			vm.push(code[ip].index)
+			vm.push(instruction.index)
+		case oPushb:
+			vm.push(instruction.index != 0)
+		case oPushc:
+			vm.push(vm.module.constantTable[instruction.index])
+		case oPushNone:
+			vm.push(TMachineStackRecord{stackType: stNone})
+		case oLoad:
+			global := vm.module.globals[instruction.index]
+			if global.Value.stackType == stNone {
+				vm.runtimeError(ErrUndefinedVariable, "variable '%s' has no value", global.Name)
+			}
+			vm.push(global.Value)
+		case oStore:
+			vm.module.globals[instruction.index].Value = vm.pop()
+		case oLoadLocal:
+			value := vm.stack[vm.base+instruction.index]
+			if value.stackType == stReference { // boxed by oRefLocal
+				value = *value.lValue.(*TMachineStackRecord)
+			}
+			if value.stackType == stNone || value.stackType == stMissing {
+				vm.runtimeError(ErrUndefinedVariable, "variable '%s' has no value", vm.currentFunction().localNames[instruction.index])
+			}
+			vm.push(value)
+		case oStoreLocal:
+			if slot := &vm.stack[vm.base+instruction.index]; slot.stackType == stReference {
+				*slot.lValue.(*TMachineStackRecord) = vm.pop()
+			} else {
+				*slot = vm.pop()
+			}
+		case oLoadRef:
+			value := *vm.stack[vm.base+instruction.index].lValue.(*TMachineStackRecord)
+			if value.stackType == stNone {
+				vm.runtimeError(ErrUndefinedVariable, "variable '%s' has no value", vm.currentFunction().localNames[instruction.index])
+			}
+			vm.push(value)
+		case oStoreRef:
+			*vm.stack[vm.base+instruction.index].lValue.(*TMachineStackRecord) = vm.pop()
+		case oRefGlobal:
+			vm.push(TMachineStackRecord{stackType: stReference, lValue: &vm.module.globals[instruction.index].Value})
+		case oRefLocal:
+			// the reference can outlive the frame, it must not point into the stack
+			slot := &vm.stack[vm.base+instruction.index]
+			if slot.stackType != stReference {
+				value := *slot
+				*slot = TMachineStackRecord{stackType: stReference, lValue: &value}
+			}
+			vm.push(*slot)
+		case oRefIndexed:
+			vm.refIndexedOp(instruction.index)
+		case oLoadUpvalue:
+			function := vm.currentFunction()
+			value := *function.upvalues[instruction.index]
+			if value.stackType == stNone {
+				vm.runtimeError(ErrUndefinedVariable, "variable '%s' has no value", function.upvalueNames[instruction.index])
+			}
+			vm.push(value)
+		case oStoreUpvalue:
+			*vm.currentFunction().upvalues[instruction.index] = vm.pop()
+		case oRefUpvalue:
+			vm.push(TMachineStackRecord{stackType: stReference, lValue: vm.currentFunction().upvalues[instruction.index]})
+		case oHasValue:
+			vm.push(vm.stack[vm.base+instruction.index].stackType != stMissing)
+		case oBox:
+			value := vm.stack[vm.base+instruction.index]
+			vm.stack[vm.base+instruction.index] = TMachineStackRecord{stackType: stReference, lValue: &value}
+		case oClosure:
+			vm.closureOp(vm.module.constantTable[instruction.index].lValue.(*TFunctionObject))
 		case oAdd:
 			vm.addOp()
 		case oSub:
@@ -44,31 +163,938 @@ func (vm *VM) run(code TProgram) {
 			vm.multOp()
 		case oDivide:
 			vm.divOp()
+		case oDiv, oMod:
+			vm.integerDivOp(instruction.OpCode)
 		case oUmi:
 			vm.unaryMinusOp()
 		case oPower:
+			vm.powerOp()
+		case oEq, oNotEq, oLt, oLe, oGt, oGe:
+			vm.compareOp(instruction.OpCode)
+		case oXor:
+			vm.xorOp()
+		case oNot:
+			vm.notOp()
+		case oJmp:
+			vm.ip = instruction.index
+			continue
+		case oCheckBoolean:
+			vm.checkBoolean(vm.stack[vm.stackTop], TokenCode(instruction.index))
+		case oJmpIfTrueOrPop, oJmpIfFalseOrPop:
+			condition := vm.stack[vm.stackTop]
+			if instruction.OpCode == oJmpIfTrueOrPop {
+				vm.checkBoolean(condition, T_OR)
+			} else {
+				vm.checkBoolean(condition, T_AND)
+			}
+			if condition.bValue == (instruction.OpCode == oJmpIfTrueOrPop) {
+				vm.ip = instruction.index
+				continue
+			}
 			vm.pop()
+		case oJmpIfTrue, oJmpIfFalse:
+			condition := vm.pop()
+			if condition.stackType != stBoolean {
+				vm.runtimeError(ErrTypeMismatch, "condition must be a boolean, found %s", condition.typeName())
+			}
+			if condition.bValue == (instruction.OpCode == oJmpIfTrue) {
+				vm.ip = instruction.index
+				continue
+			}
+		case oPop:
+			vm.pop()
+		case oDup:
+			vm.push(vm.stack[vm.stackTop])
+		case oRoll:
+			value := vm.stack[vm.stackTop-instruction.index]
+			copy(vm.stack[vm.stackTop-instruction.index:vm.stackTop], vm.stack[vm.stackTop-instruction.index+1:vm.stackTop+1])
+			vm.stack[vm.stackTop] = value
+		case oUnpack:
+			vm.unpackOp(instruction.index)
+		case oForTest:
+			if !vm.forTestOp() {
+				vm.ip = instruction.index
+				continue
+			}
+		case oDowntoStep:
+			vm.downtoStepOp()
+		case oIterStart:
+			collection := vm.pop()
+			if collection.stackType != stList && collection.stackType != stString && collection.stackType != stMap {
+				vm.runtimeError(ErrTypeMismatch, "for in expects a list, a string or a map, found %s", collection.typeName())
+			}
+			vm.push(TMachineStackRecord{stackType: stIterator, lValue: newIterator(collection)})
+		case oIterNext:
+			value, ok := vm.stack[vm.stackTop].lValue.(*TIteratorObject).next()
+			if !ok {
+				vm.ip = instruction.index
+				continue
+			}
+			vm.push(value)
+		case oBuildList:
+			elements := make([]TMachineStackRecord, instruction.index)
+			copy(elements, vm.popValues(instruction.index))
+			vm.push(newListValue(elements))
+		case oBuildValues:
+			elements := make([]TMachineStackRecord, instruction.index)
+			copy(elements, vm.popValues(instruction.index))
+			vm.push(TMachineStackRecord{stackType: stValues, lValue: &TListObject{elements: elements}})
+		case oBuildMap:
+			vm.buildMapOp(instruction.index)
+		case oIn:
+			vm.inOp()
+		case oInRange:
+			vm.inRangeOp()
+		case oJumpTable:
+			vm.ip = vm.module.jumpTables[instruction.index].target(vm.stack[vm.stackTop])
+			continue
+		case oBuildSlice:
+			high := vm.pop()
+			low := vm.pop()
+			vm.push(TMachineStackRecord{stackType: stSlice, lValue: &TSliceObject{low: low, high: high}})
+		case oLoadIndexed:
+			subscripts := vm.popValues(instruction.index)
+			vm.push(vm.indexedLoad(vm.pop(), subscripts))
+		case oStoreIndexed:
+			value := vm.pop()
+			subscripts := vm.popValues(instruction.index)
+			vm.indexedStore(vm.pop(), subscripts, value)
+		case oMultipleValues:
+			vm.multipleValues = true
+		case oCall:
+			if vm.callOp(instruction.index, nil) {
+				continue
+			}
+		case oCallNamed:
+			elements := vm.pop().lValue.(*TListObject).elements
+			names := make([]string, len(elements))
+			for i, name := range elements {
+				names[i] = name.sValue
+			}
+			if vm.callOp(instruction.index, names) {
+				continue
+			}
+		case oReturn:
+			vm.returnOp()
+		case oPrint, oPrintln:
+			vm.printOp(instruction.index, instruction.OpCode == oPrintln)
 		case oHalt:
-			break
+			return
+		default:
+			vm.runtimeError(ErrRuntime, "unknown opcode encountered in virual machine execution loop")
+		}
+		vm.ip += 1
+	}
+}
+
+// compareOp pops two values and pushes the result of comparing them. Any
+// two values can be tested with == and !=, see valuesEqual. Only numbers,
+// by value, and strings, in lexicographic order, can be ordered.
+func (vm *VM) compareOp(opCode OpCode) {
+	right := vm.pop()
+	left := vm.pop()
+	switch opCode {
+	case oEq:
+		vm.push(valuesEqual(left, right))
+		return
+	case oNotEq:
+		vm.push(!valuesEqual(left, right))
+		return
+	}
+	var result int
+	switch {
+	case isNumber(left) && isNumber(right):
+		var ordered bool
+		if result, ordered = compareNumbers(left, right); !ordered {
+			vm.push(false) // NaN is neither less, equal nor greater than anything
+			return
+		}
+	case left.stackType == stString && right.stackType == stString:
+		result = strings.Compare(left.sValue, right.sValue)
+	case left.stackType == right.stackType:
+		vm.runtimeError(ErrTypeMismatch, "%s values cannot be ordered, only numbers and strings can", left.typeName())
+	default:
+		vm.runtimeError(ErrTypeMismatch, "cannot compare %s with %s", left.typeName(), right.typeName())
+	}
+	switch opCode {
+	case oLt:
+		vm.push(result < 0)
+	case oLe:
+		vm.push(result <= 0)
+	case oGt:
+		vm.push(result > 0)
+	case oGe:
+		vm.push(result >= 0)
+	}
+}
+
+// inRangeOp is the test of a case label low..high, the bounds are two
+// numbers or two strings and a value of another type is not in the range
+func (vm *VM) inRangeOp() {
+	high := vm.pop()
+	low := vm.pop()
+	value := vm.pop()
+	if !(isNumber(low) && isNumber(high)) && !(low.stackType == stString && high.stackType == stString) {
+		vm.runtimeError(ErrTypeMismatch, "the bounds of a case range must be numbers or strings, found %s..%s", low.typeName(), high.typeName())
+	}
+	fromLow, lowOk := compareOrdered(low, value)
+	toHigh, highOk := compareOrdered(value, high)
+	vm.push(lowOk && highOk && fromLow <= 0 && toHigh <= 0)
+}
+
+// compareOrdered orders two numbers or two strings, ok is false for any
+// other pair of values and when a number is NaN
+func compareOrdered(a, b TMachineStackRecord) (result int, ok bool) {
+	if isNumber(a) && isNumber(b) {
+		return compareNumbers(a, b)
+	}
+	if a.stackType == stString && b.stackType == stString {
+		return strings.Compare(a.sValue, b.sValue), true
+	}
+	return 0, false
+}
+
+func isNumber(value TMachineStackRecord) bool {
+	return value.stackType == stInteger || value.stackType == stDouble
+}
+
+// compareNumbers returns -1, 0 or 1 as a is less than, equal to or greater
+// than b. An integer and a double are compared exactly, without rounding the
+// integer to a double. ordered is false when one of them is NaN.
+func compareNumbers(a, b TMachineStackRecord) (result int, ordered bool) {
+	switch {
+	case a.stackType == stInteger && b.stackType == stInteger:
+		return compareInts(a.iValue, b.iValue), true
+	case a.stackType == stInteger:
+		return compareIntDouble(a.iValue, b.dValue)
+	case b.stackType == stInteger:
+		result, ordered = compareIntDouble(b.iValue, a.dValue)
+		return -result, ordered
+	}
+	if math.IsNaN(a.dValue) || math.IsNaN(b.dValue) {
+		return 0, false
+	}
+	if a.dValue < b.dValue {
+		return -1, true
+	} else if a.dValue > b.dValue {
+		return 1, true
+	}
+	return 0, true
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareIntDouble(i int, d float64) (int, bool) {
+	switch {
+	case math.IsNaN(d):
+		return 0, false
+	case d >= math.MaxInt64:
+		return -1, true
+	case d < math.MinInt64:
+		return 1, true
+	}
+	whole := math.Trunc(d)
+	if result := compareInts(i, int(whole)); result != 0 {
+		return result, true
+	}
+	// same integer part, the fraction of d decides
+	if d > whole {
+		return -1, true
+	} else if d < whole {
+		return 1, true
+	}
+	return 0, true
+}
+
+func toDouble(value TMachineStackRecord) float64 {
+	if value.stackType == stInteger {
+		return float64(value.iValue)
+	}
+	return value.dValue
+}
+
+// callOp calls the function found below argCount arguments on the stack,
+// the last len(names) arguments are given by name. A builtin replaces the
+// function and its arguments with the result, a Rhodus function gets a new
+// frame whose locals start at its first parameter and callOp returns true,
+// execution goes on at the start of the function.
+func (vm *VM) callOp(argCount int, names []string) bool {
+	callee := vm.stack[vm.stackTop-argCount]
+	multipleValues := vm.multipleValues
+	vm.multipleValues = false
+	switch callee.stackType {
+	case stBuiltin:
+		if len(names) > 0 {
+			vm.runtimeError(ErrRuntime, "builtin '%s' does not accept arguments given by name", callee.lValue.(*TBuiltinFunction).Name)
+		}
+		args := make([]TMachineStackRecord, argCount)
+		copy(args, vm.popValues(argCount))
+		vm.pop()
+		result, err := callee.lValue.(*TBuiltinFunction).call(args)
+		if err != nil {
+			vm.runtimeError(ErrRuntime, "%s", err)
+		}
+		vm.push(result)
+	case stFunction:
+		function := callee.lValue.(*TFunctionObject)
+		if argCount != function.arity() || len(names) > 0 || function.variadic() {
+			vm.matchArguments(function, argCount, names)
+		}
+		if len(vm.frames) >= vm.maxCallDepth {
+			vm.runtimeError(ErrStackOverflow, "stack overflow, more than %d nested calls", vm.maxCallDepth)
+		}
+		vm.frames = append(vm.frames, TCallFrame{function: function, code: vm.code, ip: vm.ip, base: vm.base, multipleValues: multipleValues})
+		vm.base = vm.stackTop - function.arity() + 1
+		for i := function.arity(); i < function.nLocals; i++ {
+			vm.push(TMachineStackRecord{stackType: stNone})
+		}
+		vm.bindArguments(function)
+		vm.code = function.Code
+		vm.ip = 0
+		return true
+	default:
+		vm.runtimeError(ErrTypeMismatch, "a value of type %s cannot be called", callee.typeName())
+	}
+	return false
+}
+
+// unpackOp replaces the list, or the values returned by a function, on top
+// of the stack by its count elements
+func (vm *VM) unpackOp(count int) {
+	value := vm.pop()
+	if value.stackType != stList && value.stackType != stValues {
+		vm.runtimeError(ErrTypeMismatch, "cannot assign %s to %d variables, expecting a list", value.typeName(), count)
+	}
+	elements := value.lValue.(*TListObject).elements
+	if value.stackType == stValues && len(elements) != count {
+		vm.runtimeError(ErrDimensionMismatch, "cannot assign %d values to %d variables", len(elements), count)
+	}
+	if len(elements) != count {
+		vm.runtimeError(ErrDimensionMismatch, "assignment to %d variables expects a list of %d elements, found %d", count, count, len(elements))
+	}
+	for _, element := range elements {
+		vm.push(element)
+	}
+}
+
+// matchArguments replaces the argCount arguments on the stack by the values
+// of the parameters of function, in order. A parameter without argument is
+// marked missing for the code of its default value, the variadic
+// parameter gets a list with the extra arguments.
+func (vm *VM) matchArguments(function *TFunctionObject, argCount int, names []string) {
+	binding, extra, err := matchArguments(function.Name, function.Parameters, argCount-len(names), names)
+	if err != nil {
+		vm.runtimeError(ErrRuntime, "%s", err)
+	}
+	args := make([]TMachineStackRecord, argCount)
+	copy(args, vm.popValues(argCount))
+	for p, argument := range binding {
+		switch {
+		case function.Parameters[p].IsVariadic:
+			elements := make([]TMachineStackRecord, len(extra))
+			for i, argument := range extra {
+				elements[i] = args[argument]
+			}
+			vm.push(newListValue(elements))
+		case argument >= 0:
+			vm.push(args[argument])
+		default:
+			vm.push(TMachineStackRecord{stackType: stMissing})
+		}
+	}
+}
+
+// closureOp pops the references to the variables captured by function and
+// pushes a copy of the function that holds them
+func (vm *VM) closureOp(function *TFunctionObject) {
+	closure := *function
+	closure.upvalues = make([]*TMachineStackRecord, len(function.upvalueNames))
+	for i, reference := range vm.popValues(len(closure.upvalues)) {
+		closure.upvalues[i] = reference.lValue.(*TMachineStackRecord)
+	}
+	vm.push(TMachineStackRecord{stackType: stFunction, lValue: &closure})
+}
+
+// bindArguments checks the arguments of the new frame against the parameters
+// of function. The compiler passes references only when it knows the function
+// being called, a ref parameter of a function called through a variable would
+// get a copy of the argument and is an error. A reference given to a plain
+// parameter is replaced by its value.
+func (vm *VM) bindArguments(function *TFunctionObject) {
+	for i, parameter := range function.Parameters {
+		argument := &vm.stack[vm.base+i]
+		if parameter.IsRef && argument.stackType != stReference {
+			vm.runtimeError(ErrRuntime, "ref parameter '%s' of function '%s' needs a variable, the function must be called by its name", parameter.Name, function.Name)
+		} else if !parameter.IsRef && argument.stackType == stReference {
+			*argument = *argument.lValue.(*TMachineStackRecord)
+		}
+	}
+}
+
+// refIndexedOp pops count subscripts and the container and pushes a
+// reference to the list element or the map value
+func (vm *VM) refIndexedOp(count int) {
+	subscripts := vm.popValues(count)
+	container := vm.pop()
+	for len(subscripts) > 1 {
+		container = *vm.containerElement(container, subscripts[0])
+		subscripts = subscripts[1:]
+	}
+	switch container.stackType {
+	case stList, stMap:
+		vm.push(TMachineStackRecord{stackType: stReference, lValue: vm.containerElement(container, subscripts[0])})
+	case stMatrix:
+		vm.runtimeError(ErrTypeMismatch, "a matrix element cannot be passed to a ref parameter")
+	default:
+		vm.runtimeError(ErrTypeMismatch, "a value of type %s cannot be indexed", container.typeName())
+	}
+}
+
+// forTestOp pops the loop variable and returns true while it has not gone
+// past the final value, the final value and the step are below it
+func (vm *VM) forTestOp() bool {
+	variable := vm.pop()
+	step := vm.stack[vm.stackTop]
+	stop := vm.stack[vm.stackTop-1]
+	if !isNumber(variable) || !isNumber(stop) || !isNumber(step) {
+		vm.runtimeError(ErrTypeMismatch, "the limits and the step of a for loop must be numbers")
+	}
+	if variable.stackType == stInteger && stop.stackType == stInteger && step.stackType == stInteger {
+		if step.iValue == 0 {
+			vm.runtimeError(ErrRuntime, "the step of a for loop cannot be zero")
+		}
+		return (step.iValue > 0 && variable.iValue <= stop.iValue) || (step.iValue < 0 && variable.iValue >= stop.iValue)
+	}
+	if toDouble(step) == 0 {
+		vm.runtimeError(ErrRuntime, "the step of a for loop cannot be zero")
+	}
+	return (toDouble(step) > 0 && toDouble(variable) <= toDouble(stop)) || (toDouble(step) < 0 && toDouble(variable) >= toDouble(stop))
+}
+
+// downtoStepOp negates the step of a downto loop, a negative step would
+// count up and is an error like it is when the step is a constant
+func (vm *VM) downtoStepOp() {
+	step := vm.stack[vm.stackTop]
+	if isNumber(step) && toDouble(step) < 0 {
+		vm.runtimeError(ErrRuntime, "the step of a downto loop cannot be negative, found %s", step.toString())
+	}
+	vm.unaryMinusOp()
+}
+
+// buildMapOp pops count key and value pairs and pushes a map holding them
+func (vm *VM) buildMapOp(count int) {
+	pairs := vm.popValues(2 * count)
+	m := newMapObject()
+	for i := 0; i < len(pairs); i += 2 {
+		entry, err := m.entry(pairs[i])
+		if err != nil {
+			vm.runtimeError(ErrTypeMismatch, "%s", err)
+		}
+		entry.value = pairs[i+1]
+	}
+	vm.push(newMapValue(m))
+}
+
+// inOp tests if a key is in a map, an element in a list or a string in a string
+func (vm *VM) inOp() {
+	container := vm.pop()
+	value := vm.pop()
+	switch container.stackType {
+	case stMap:
+		entry, err := container.lValue.(*TMapObject).lookup(value)
+		if err != nil {
+			vm.runtimeError(ErrTypeMismatch, "%s", err)
+		}
+		vm.push(entry != nil)
+	case stList:
+		for _, element := range container.lValue.(*TListObject).elements {
+			if valuesEqual(value, element) {
+				vm.push(true)
+				return
+			}
+		}
+		vm.push(false)
+	case stString:
+		if value.stackType != stString {
+			vm.runtimeError(ErrTypeMismatch, "in a string expects a string, found %s", value.typeName())
+		}
+		vm.push(strings.Contains(container.sValue, value.sValue))
+	default:
+		vm.runtimeError(ErrTypeMismatch, "in expects a map, a list or a string, found %s", container.typeName())
+	}
+}
+
+// indexedLoad returns the element or the slice of container selected by
+// the subscripts, list[i, j] is the same as list[i][j] and indices start at 0
+func (vm *VM) indexedLoad(container TMachineStackRecord, subscripts []TMachineStackRecord) TMachineStackRecord {
+	for len(subscripts) > 0 {
+		switch container.stackType {
+		case stList:
+			list := container.lValue.(*TListObject)
+			if subscripts[0].stackType == stSlice {
+				low, high := vm.sliceBounds(subscripts[0], len(list.elements))
+				elements := make([]TMachineStackRecord, high-low)
+				copy(elements, list.elements[low:high])
+				container = newListValue(elements)
+			} else {
+				container = *vm.listElement(list, subscripts[0])
+			}
+			subscripts = subscripts[1:]
+		case stMap:
+			entry, err := container.lValue.(*TMapObject).lookup(subscripts[0])
+			if err != nil {
+				vm.runtimeError(ErrTypeMismatch, "%s", err)
+			}
+			if entry == nil {
+				vm.runtimeError(ErrKeyNotFound, "key %s not found in the map", elementString(subscripts[0]))
+			}
+			container = entry.value
+			subscripts = subscripts[1:]
+		case stMatrix:
+			return vm.matrixLoad(container.lValue.(*TMatrixObject), subscripts)
+		default:
+			vm.runtimeError(ErrTypeMismatch, "a value of type %s cannot be indexed", container.typeName())
+		}
+	}
+	return container
+}
+
+// indexedStore assigns value to the element of container selected by the
+// subscripts. The container is a reference when the target of the
+// assignment is a variable, an unassigned variable with two subscripts
+// becomes a matrix that grows to hold the element.
+func (vm *VM) indexedStore(container TMachineStackRecord, subscripts []TMachineStackRecord, value TMachineStackRecord) {
+	if container.stackType == stReference {
+		variable := container.lValue.(*TMachineStackRecord)
+		if variable.stackType == stNone && len(subscripts) == 2 {
+			*variable = newMatrixValue(newMatrix(0, 0))
+		}
+		container = *variable
+	}
+	for (container.stackType == stList || container.stackType == stMap) && len(subscripts) > 1 {
+		container = *vm.containerElement(container, subscripts[0])
+		subscripts = subscripts[1:]
+	}
+	switch container.stackType {
+	case stList:
+		*vm.listElement(container.lValue.(*TListObject), subscripts[0]) = value
+	case stMap:
+		entry, err := container.lValue.(*TMapObject).entry(subscripts[0])
+		if err != nil {
+			vm.runtimeError(ErrTypeMismatch, "%s", err)
+		}
+		entry.value = value
+	case stMatrix:
+		vm.matrixStore(container.lValue.(*TMatrixObject), subscripts, value)
+	default:
+		vm.runtimeError(ErrTypeMismatch, "a value of type %s cannot be indexed", container.typeName())
+	}
+}
+
+// containerElement returns the list element or the value of the map key
+// selected by subscript, a missing key is an error
+func (vm *VM) containerElement(container TMachineStackRecord, subscript TMachineStackRecord) *TMachineStackRecord {
+	switch container.stackType {
+	case stList:
+		return vm.listElement(container.lValue.(*TListObject), subscript)
+	case stMap:
+		entry, err := container.lValue.(*TMapObject).lookup(subscript)
+		if err != nil {
+			vm.runtimeError(ErrTypeMismatch, "%s", err)
+		}
+		if entry == nil {
+			vm.runtimeError(ErrKeyNotFound, "key %s not found in the map", elementString(subscript))
+		}
+		return &entry.value
+	case stMatrix:
+		vm.runtimeError(ErrTypeMismatch, "a matrix element cannot be indexed")
+	}
+	vm.runtimeError(ErrTypeMismatch, "a value of type %s cannot be indexed", container.typeName())
+	return nil
+}
+
+func (vm *VM) listElement(list *TListObject, subscript TMachineStackRecord) *TMachineStackRecord {
+	if subscript.stackType == stSlice {
+		vm.runtimeError(ErrTypeMismatch, "cannot assign to a slice of a list")
+	}
+	return &list.elements[vm.index(subscript, len(list.elements), "list")]
+}
+
+// index checks that subscript is an integer between 0 and size-1, name
+// is list, row or column
+func (vm *VM) index(subscript TMachineStackRecord, size int, name string) int {
+	if subscript.stackType != stInteger {
+		vm.runtimeError(ErrTypeMismatch, "%s index must be an integer, found %s", name, subscript.typeName())
+	}
+	if subscript.iValue < 0 || subscript.iValue >= size {
+		switch name {
+		case "list":
+			vm.runtimeError(ErrIndexOutOfRange, "list index %d out of range, the list has %d elements", subscript.iValue, size)
 		default:
-			fmt.Println("unknown opcode encountered in virual machine execution loop")
-			os.Exit(1)
+			vm.runtimeError(ErrIndexOutOfRange, "%s index %d out of range, the matrix has %d %ss", name, subscript.iValue, size, name)
+		}
+	}
+	return subscript.iValue
+}
+
+// sliceBounds returns the first index and the index after the last one of
+// the slice low:high on a dimension of size elements
+func (vm *VM) sliceBounds(subscript TMachineStackRecord, size int) (int, int) {
+	slice := subscript.lValue.(*TSliceObject)
+	low, high := 0, size
+	if slice.low.stackType != stNone {
+		if slice.low.stackType != stInteger {
+			vm.runtimeError(ErrTypeMismatch, "slice bounds must be integers, found %s", slice.low.typeName())
+		}
+		low = slice.low.iValue
+	}
+	if slice.high.stackType != stNone {
+		if slice.high.stackType != stInteger {
+			vm.runtimeError(ErrTypeMismatch, "slice bounds must be integers, found %s", slice.high.typeName())
+		}
+		high = slice.high.iValue
+	}
+	if low < 0 || high > size || low > high {
+		vm.runtimeError(ErrIndexOutOfRange, "slice %d:%d out of range, the dimension has %d elements", low, high, size)
+	}
+	return low, high
+}
+
+// matrixRange returns the rows or columns selected by a subscript, single
+// is true when the subscript is an index instead of a slice
+func (vm *VM) matrixRange(subscript TMachineStackRecord, size int, name string) (low, high int, single bool) {
+	if subscript.stackType == stSlice {
+		low, high = vm.sliceBounds(subscript, size)
+		return low, high, false
+	}
+	low = vm.index(subscript, size, name)
+	return low, low + 1, true
+}
+
+// matrixLoad returns the element m[i, j] as a double, m[i] is row i, and
+// slices such as m[i, :] or m[0:2, 1:3] return a new matrix
+func (vm *VM) matrixLoad(m *TMatrixObject, subscripts []TMachineStackRecord) TMachineStackRecord {
+	if len(subscripts) > 2 {
+		vm.runtimeError(ErrTypeMismatch, "a matrix takes one or two subscripts, found %d", len(subscripts))
+	}
+	rowLow, rowHigh, singleRow := vm.matrixRange(subscripts[0], m.rows, "row")
+	colLow, colHigh, singleCol := 0, m.cols, false
+	if len(subscripts) == 2 {
+		colLow, colHigh, singleCol = vm.matrixRange(subscripts[1], m.cols, "column")
+	}
+	if singleRow && singleCol {
+		return TMachineStackRecord{stackType: stDouble, dValue: m.get(rowLow, colLow)}
+	}
+	return newMatrixValue(m.subMatrix(rowLow, rowHigh, colLow, colHigh))
+}
+
+// matrixStore assigns a number to m[i, j], the matrix grows when the
+// element is outside its rows or columns
+func (vm *VM) matrixStore(m *TMatrixObject, subscripts []TMachineStackRecord, value TMachineStackRecord) {
+	if len(subscripts) != 2 {
+		vm.runtimeError(ErrTypeMismatch, "a matrix element is assigned with two subscripts, found %d", len(subscripts))
+	}
+	if !isNumber(value) {
+		vm.runtimeError(ErrTypeMismatch, "matrix elements must be numbers, found %s", value.typeName())
+	}
+	for i, name := range []string{"row", "column"} {
+		if subscripts[i].stackType != stInteger {
+			vm.runtimeError(ErrTypeMismatch, "%s index must be an integer, found %s", name, subscripts[i].typeName())
+		}
+		if subscripts[i].iValue < 0 {
+			vm.runtimeError(ErrIndexOutOfRange, "%s index %d out of range", name, subscripts[i].iValue)
+		}
+	}
+	row, col := subscripts[0].iValue, subscripts[1].iValue
+	if row >= m.rows || col >= m.cols {
+		rows, cols := m.rows, m.cols
+		if row >= rows {
+			rows = row + 1
+		}
+		if col >= cols {
+			cols = col + 1
+		}
+		if err := checkMatrixSize(rows, cols); err != nil {
+			vm.runtimeError(ErrIndexOutOfRange, "cannot assign element [%d, %d], %s", row, col, err)
+		}
+		m.resize(rows, cols)
+	}
+	m.set(row, col, toDouble(value))
+}
+
+// matrixOp computes left op right when an operand is a matrix: + and -
+// work element by element, * is the matrix product or multiplies every
+// element by a number, and / divides every element by a number. It
+// returns false when the operation is not defined for the operands.
+func (vm *VM) matrixOp(opCode OpCode, left, right TMachineStackRecord) bool {
+	switch {
+	case left.stackType == stMatrix && right.stackType == stMatrix:
+		a, b := left.lValue.(*TMatrixObject), right.lValue.(*TMatrixObject)
+		switch opCode {
+		case oAdd, oSub:
+			if a.rows != b.rows || a.cols != b.cols {
+				vm.runtimeError(ErrDimensionMismatch, "matrix dimensions do not match: %s and %s", a.dimensions(), b.dimensions())
+			}
+			vm.push(newMatrixValue(a.add(b, opCode == oSub)))
+		case oMult:
+			if a.cols != b.rows {
+				vm.runtimeError(ErrDimensionMismatch, "cannot multiply a %s matrix by a %s matrix", a.dimensions(), b.dimensions())
+			}
+			if err := checkMatrixSize(a.rows, b.cols); err != nil {
+				vm.runtimeError(ErrDimensionMismatch, "%s", err)
+			}
+			vm.push(newMatrixValue(a.multiply(b)))
+		default:
+			return false
+		}
+	case left.stackType == stMatrix && isNumber(right) && opCode == oMult:
+		vm.push(newMatrixValue(left.lValue.(*TMatrixObject).scale(toDouble(right))))
+	case isNumber(left) && right.stackType == stMatrix && opCode == oMult:
+		vm.push(newMatrixValue(right.lValue.(*TMatrixObject).scale(toDouble(left))))
+	case left.stackType == stMatrix && isNumber(right) && opCode == oDivide:
+		if toDouble(right) == 0 {
+			vm.runtimeError(ErrDivisionByZero, "division by zero")
+		}
+		vm.push(newMatrixValue(left.lValue.(*TMatrixObject).scale(1 / toDouble(right))))
+	default:
+		return false
+	}
+	return true
+}
+
+// returnOp removes the frame of the running function, its locals and the
+// function value, and leaves the result on the stack of the caller
+func (vm *VM) returnOp() {
+	result := vm.pop()
+	frame := vm.frames[len(vm.frames)-1]
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	vm.stackTop = vm.base - 2
+	vm.code = frame.code
+	vm.ip = frame.ip
+	vm.base = frame.base
+	if result.stackType == stValues && !frame.multipleValues {
+		vm.runtimeError(ErrTypeMismatch, "function '%s' returns %d values where a single value is expected",
+			frame.function.Name, len(result.lValue.(*TListObject).elements))
+	}
+	vm.push(result)
+}
+
+// currentFunction returns the function being executed, nil at module level
+func (vm *VM) currentFunction() *TFunctionObject {
+	if len(vm.frames) == 0 {
+		return nil
+	}
+	return vm.frames[len(vm.frames)-1].function
+}
+
+// printOp pops count values and writes them without separators
+func (vm *VM) printOp(count int, newLine bool) {
+	values := make([]TMachineStackRecord, count)
+	for i := count - 1; i >= 0; i-- {
+		values[i] = vm.pop()
+	}
+	for _, value := range values {
+		fmt.Fprint(vm.stdout, value.toString())
+	}
+	if newLine {
+		fmt.Fprintln(vm.stdout)
+	}
+}
+
+// addOp adds numbers, an integer is promoted to double when the other
+// operand is a double, and concatenates strings
+func (vm *VM) addOp() {
+	right := vm.pop()
+	left := vm.pop()
+	switch {
+	case left.stackType == stInteger && right.stackType == stInteger:
+		vm.push(left.iValue + right.iValue)
+	case isNumber(left) && isNumber(right):
+		vm.push(toDouble(left) + toDouble(right))
+	case left.stackType == stString && right.stackType == stString:
+		vm.push(left.sValue + right.sValue)
+	default:
+		if vm.matrixOp(oAdd, left, right) {
+			return
+		}
+		vm.runtimeError(ErrTypeMismatch, "incompatible types in addition: %s + %s", left.typeName(), right.typeName())
+	}
+}
+
+func (vm *VM) subOp() {
+	right := vm.pop()
+	left := vm.pop()
+	switch {
+	case left.stackType == stInteger && right.stackType == stInteger:
+		vm.push(left.iValue - right.iValue)
+	case isNumber(left) && isNumber(right):
+		vm.push(toDouble(left) - toDouble(right))
+	default:
+		if vm.matrixOp(oSub, left, right) {
+			return
+		}
+		vm.runtimeError(ErrTypeMismatch, "incompatible types in subtraction: %s - %s", left.typeName(), right.typeName())
+	}
+}
+
+func (vm *VM) multOp() {
+	right := vm.pop()
+	left := vm.pop()
+	switch {
+	case left.stackType == stInteger && right.stackType == stInteger:
+		vm.push(left.iValue * right.iValue)
+	case isNumber(left) && isNumber(right):
+		vm.push(toDouble(left) * toDouble(right))
+	default:
+		if vm.matrixOp(oMult, left, right) {
+			return
 		}
-		ip += 1
+		vm.runtimeError(ErrTypeMismatch, "incompatible types in multiplication: %s * %s", left.typeName(), right.typeName())
 	}
 }
 
-func (vm *VM) addOp()        {}
-func (vm *VM) subOp()        {}
-func (vm *VM) multOp()       {}
-func (vm *VM) divOp()        {}
-func (vm *VM) unaryMinusOp() {}
+// divOp always returns a double, use div for integer division
+func (vm *VM) divOp() {
+	right := vm.pop()
+	left := vm.pop()
+	if !isNumber(left) || !isNumber(right) {
+		if vm.matrixOp(oDivide, left, right) {
+			return
+		}
+		vm.runtimeError(ErrTypeMismatch, "incompatible types in division: %s / %s", left.typeName(), right.typeName())
+	}
+	if toDouble(right) == 0 {
+		vm.runtimeError(ErrDivisionByZero, "division by zero")
+	}
+	vm.push(toDouble(left) / toDouble(right))
+}
+
+// integerDivOp implements div and mod, both operands must be integers
+func (vm *VM) integerDivOp(opCode OpCode) {
+	right := vm.pop()
+	left := vm.pop()
+	if left.stackType != stInteger || right.stackType != stInteger {
+		if opCode == oDiv {
+			vm.runtimeError(ErrTypeMismatch, "incompatible types in integer division: %s div %s", left.typeName(), right.typeName())
+		}
+		vm.runtimeError(ErrTypeMismatch, "incompatible types in modulus: %s mod %s", left.typeName(), right.typeName())
+	}
+	if right.iValue == 0 {
+		vm.runtimeError(ErrDivisionByZero, "division by zero")
+	}
+	if opCode == oDiv {
+		vm.push(left.iValue / right.iValue)
+	} else {
+		vm.push(left.iValue % right.iValue)
+	}
+}
+
+func (vm *VM) unaryMinusOp() {
+	value := vm.pop()
+	switch value.stackType {
+	case stInteger:
+		vm.push(-value.iValue)
+	case stDouble:
+		vm.push(-value.dValue)
+	case stMatrix:
+		vm.push(newMatrixValue(value.lValue.(*TMatrixObject).scale(-1)))
+	default:
+		vm.runtimeError(ErrTypeMismatch, "unary minus cannot be applied to a %s", value.typeName())
+	}
+}
+
+func (vm *VM) powerOp() {
+	exponent := vm.pop()
+	base := vm.pop()
+	if !isNumber(base) || !isNumber(exponent) {
+		vm.runtimeError(ErrTypeMismatch, "incompatible types in power: %s ^ %s", base.typeName(), exponent.typeName())
+	}
+	if base.stackType == stInteger && exponent.stackType == stInteger && exponent.iValue >= 0 {
+		if result, ok := integerPower(base.iValue, exponent.iValue); ok {
+			vm.push(result)
+			return
+		}
+	}
+	vm.push(math.Pow(toDouble(base), toDouble(exponent)))
+}
+
+// integerPower computes base^exponent by repeated squaring, exponent >= 0.
+// It returns false when the result does not fit in an integer, the power is
+// then computed with doubles.
+func integerPower(base, exponent int) (int, bool) {
+	result := 1
+	for ok := true; exponent > 0; exponent >>= 1 {
+		if exponent&1 == 1 {
+			if result, ok = multiplyInts(result, base); !ok {
+				return 0, false
+			}
+		}
+		if exponent > 1 {
+			if base, ok = multiplyInts(base, base); !ok {
+				return 0, false
+			}
+		}
+	}
+	return result, true
+}
+
+// multiplyInts returns a*b and false when the product overflows
+func multiplyInts(a, b int) (int, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	product := a * b
+	if product/b != a || (a == -1 && b == math.MinInt) || (b == -1 && a == math.MinInt) {
+		return 0, false
+	}
+	return product, true
+}
+
+func (vm *VM) xorOp() {
+	right := vm.pop()
+	left := vm.pop()
+	vm.checkBoolean(left, T_XOR)
+	vm.checkBoolean(right, T_XOR)
+	vm.push(left.bValue != right.bValue)
+}
+
+// checkBoolean stops with a type error when an operand of and, or or xor is not a boolean
+func (vm *VM) checkBoolean(value TMachineStackRecord, operator TokenCode) {
+	if value.stackType != stBoolean {
+		vm.runtimeError(ErrTypeMismatch, "%s expects boolean operands, found %s", TokenSpelling(operator), value.typeName())
+	}
+}
+
+func (vm *VM) notOp() {
+	value := vm.pop()
+	if value.stackType != stBoolean {
+		vm.runtimeError(ErrTypeMismatch, "not cannot be applied to a %s", value.typeName())
+	}
+	vm.push(!value.bValue)
+}
 
 func (vm *VM) checkStackOverflow() {
 	if vm.stackTop == vm.stackSize {
-		fmt.Println("Stack overflow error.")
-		os.Exit(1)
+		vm.stackTop -= 1
+		vm.runtimeError(ErrStackOverflow, "stack overflow error")
+	}
+}
+
+// popValues removes the count values on top of the stack and returns them
+// in the order they were pushed, the slice is only valid until the next push
+func (vm *VM) popValues(count int) []TMachineStackRecord {
+	if vm.stackTop+1 < count {
+		vm.runtimeError(ErrStackUnderflow, "stack underflow error")
 	}
+	vm.stackTop -= count
+	return vm.stack[vm.stackTop+1 : vm.stackTop+1+count]
 }
 
 func (vm *VM) pop() TMachineStackRecord {
@@ -77,8 +1103,7 @@ func (vm *VM) pop() TMachineStackRecord {
 		vm.stackTop -= 1
 		return result
 	}
-	fmt.Println("Stack underflow error")
-	os.Exit(1)
+	vm.runtimeError(ErrStackUnderflow, "stack underflow error")
 	return TMachineStackRecord{}
 }
 
@@ -87,17 +1112,15 @@ func (vm *VM) push(value interface{}) {
 	vm.checkStackOverflow()
 	switch value := value.(type) {
 	case int:
-		vm.stack[vm.stackTop].iValue = value
-		vm.stack[vm.stackTop].stackType = stInteger
+		vm.stack[vm.stackTop] = TMachineStackRecord{stackType: stInteger, iValue: value}
 	case float64:
-		vm.stack[vm.stackTop].dValue = value
-		vm.stack[vm.stackTop].stackType = stDouble
+		vm.stack[vm.stackTop] = TMachineStackRecord{stackType: stDouble, dValue: value}
 	case bool:
-		vm.stack[vm.stackTop].bValue = value
-		vm.stack[vm.stackTop].stackType = stBoolean
+		vm.stack[vm.stackTop] = TMachineStackRecord{stackType: stBoolean, bValue: value}
 	case string:
-		vm.stack[vm.stackTop].sValue = value
-		vm.stack[vm.stackTop].stackType = stString
+		vm.stack[vm.stackTop] = TMachineStackRecord{stackType: stString, sValue: value}
+	case TMachineStackRecord:
+		vm.stack[vm.stackTop] = value
 	}
 
 }
@@ -0,0 +1,387 @@
+package src
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// run evaluates script in a new interpreter and returns what it printed
+func run(script string) (string, error) {
+	in := NewInterpreter()
+	var out bytes.Buffer
+	in.SetStdout(&out)
+	in.SetStderr(ioutil.Discard)
+	err := in.EvalString(script)
+	return out.String(), err
+}
+
+// diagnosticCode returns the code of the first diagnostic of err, 0 for nil
+func diagnosticCode(t *testing.T, err error) ErrorCode {
+	switch err := err.(type) {
+	case nil:
+		return 0
+	case *Diagnostic:
+		return err.Code
+	case DiagnosticList:
+		return err[0].Code
+	}
+	t.Fatalf("unexpected error %v", err)
+	return 0
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		output string
+		code   ErrorCode
+	}{
+		{"arithmetic",
+			`x = 1 + 2 * 3; println(x, " ", 7 div 2, " ", 7 mod 2, " ", 1 / 4)`, "7 3 1 0.25\n", 0},
+		{"globals and lists",
+			`x = {1, 2}; y = x[1]; println(y)`, "2\n", 0},
+		{"recursion",
+			`function fact(n) if n < 2 then return 1 end; return n * fact(n - 1) end; println(fact(10))`, "3628800\n", 0},
+		{"locals of each call",
+			`function f(n) x = n * 2; if n > 0 then f(n - 1) end; print(x, " ") end; f(2)`, "0 2 4 ", 0},
+		{"ref parameter",
+			`function swap(ref a, ref b) t = a; a = b; b = t end; x = 1; y = 2; swap(x, y); println(x, y)`, "21\n", 0},
+		{"ref parameter of a local variable",
+			`function inc(ref v) v = v + 1 end;
+			 function w() y = 1; inc(y); inc(y); return y end;
+			 println(w())`, "3\n", 0},
+		{"list printing",
+			`println({1, "a", {2.5, True}}, " ", {})`, "{1, \"a\", {2.5, True}} {}\n", 0},
+		{"lists are shared by reference",
+			`a = {1, 2}; b = a; b[0] = 5; function f(l) l[1] = 7 end; f(a); println(a)`, "{5, 7}\n", 0},
+		{"nested indexing",
+			`m = {{1, 2}, {3, 4}}; m[1][0] = 9; println(m[1][0] + m[0][1])`, "11\n", 0},
+		{"list equality",
+			`println({1, {2, 3}} == {1.0, {2, 3}}, " ", {1, 2} == {1, 3}, " ", {1} != {1, 1})`, "True False True\n", 0},
+		{"list that contains itself",
+			`l = {1, 2}; l[0] = l; k = {1, 2}; k[0] = k; println(l, " ", l == l, " ", l == k)`, "{{...}, 2} True True\n", 0},
+		{"list index out of range",
+			`l = {1, 2}; x = l[2]`, "", ErrIndexOutOfRange},
+		{"matrix growing",
+			`x[2, 3] = 1; println(size(x))`, "{3, 4}\n", 0},
+		{"matrix rows, columns and blocks",
+			`m = toMatrix({{1, 2, 3}, {4, 5, 6}}); println(m[1, 2], " ", m[0], " ", m[:, 1], " ", m[0:2, 1:3])`,
+			"6.0 {{1.0, 2.0, 3.0}} {{2.0}, {5.0}} {{2.0, 3.0}, {5.0, 6.0}}\n", 0},
+		{"matrix arithmetic",
+			`a = identity(2); b = toMatrix({{1, 2}, {3, 4}}); println(a * b == b, " ", (b - a) * 2)`,
+			"True {{0.0, 4.0}, {6.0, 6.0}}\n", 0},
+		{"matrix product of mismatched sizes",
+			`x = zeros(2, 3) * zeros(2, 3)`, "", ErrDimensionMismatch},
+		{"matrix growing past the limit",
+			`x[100000, 100000] = 1`, "", ErrIndexOutOfRange},
+		{"zeros past the limit",
+			`x = zeros(100000, 100000)`, "", ErrRuntime},
+		{"identity past the limit",
+			`x = identity(5000)`, "", ErrRuntime},
+		{"matrix product past the limit",
+			`x = zeros(5000, 1) * zeros(1, 5000)`, "", ErrDimensionMismatch},
+		{"map literal and printing",
+			`m = {"name": "Ann", "age": 30}; m["age"] = 31; m[2] = True; println(m, " ", {:})`,
+			"{\"name\": \"Ann\", \"age\": 31, 2: True} {:}\n", 0},
+		{"map keys, in and remove",
+			`m = {"a": 1, "b": 2, 3: "c"}; remove(m, "a"); println(keys(m), " ", "a" in m, " ", "b" in m, " ", m[3.0])`,
+			"{\"b\", 3} False True c\n", 0},
+		{"map equality ignores the order of the keys",
+			`println({"a": 1, "b": {2}} == {"b": {2}, "a": 1.0}, " ", {"a": 1} == {"a": 2})`, "True False\n", 0},
+		{"missing key",
+			`m = {"a": 1}; x = m["b"]`, "", ErrKeyNotFound},
+		{"map that contains itself",
+			`m = {:}; m["x"] = m; n = {:}; n["x"] = n; println(m, " ", m == n, " ", {"l": {m}})`,
+			"{\"x\": {...}} True {\"l\": {{\"x\": {...}}}}\n", 0},
+		{"for-in over lists, strings, maps and ranges",
+			`for x in {1, 2} do print(x) end; for c in "héllo" do print(c, ".") end; for k in {"a": 1, 5: 2} do print(k) end; for i in 3..5 do print(i) end`,
+			"12h.é.l.l.o.a5345", 0},
+		{"for-in over a map skips the keys removed by the loop",
+			`m = {"a": 1, "b": 2, "c": 3}; for k in m do print(k, m[k]); remove(m, "b"); m["d"] = 4 end`, "a1c3", 0},
+		{"for-in over a value that is not a collection",
+			`for x in 5 do end`, "", ErrTypeMismatch},
+		{"len counts characters",
+			`n = 0; for c in "héllo" do n = n + 1 end; println(n, " ", len("héllo"))`, "5 5\n", 0},
+		{"downto and step",
+			`for i = 3 downto 1 do print(i) end; for i = 10 to 0 step -4 do print(" ", i) end; for x = 0 to 1 step 0.5 do print(" ", x) end; for i = 9 downto 1 step 3 do print(" ", i) end; print(" ", i)`,
+			"321 10 6 2 0 0.5 1.0 9 6 3 0", 0},
+		{"step of zero computed at run time",
+			`s = 0; for i = 1 to 2 step s do end`, "", ErrRuntime},
+		{"negative downto step computed at run time",
+			`s = -1; for i = 5 downto 1 step s do print(i) end`, "", ErrRuntime},
+		{"break and continue",
+			`for i = 1 to 10 do if i mod 2 == 0 then continue end; if i > 7 then break end; print(i) end;
+			 i = 0; while i < 5 do i = i + 1; if i == 2 then continue end; print(i) end;
+			 i = 0; repeat i = i + 1; if i == 3 then continue end; print(i) until i >= 4;
+			 for x in {1, 2, 3} do for y in {1, 2} do if y == 2 then break end; print(x) end end`,
+			"13571345124123", 0},
+		{"short-circuit and, or",
+			`function t(s) print(s); return True end; function f(s) print(s); return False end;
+			 x = f("a") and t("b"); x = t("c") or f("d"); x = f("e") or t("f"); x = t("g") and f("h");
+			 l = {}; println(" ", len(l) > 0 and l[0] > 0)`, "acefgh False\n", 0},
+		{"boolean precedence",
+			`println(True or True and False, " ", not False and False, " ", True xor True or True, " ", not 1 > 2)`,
+			"True False True True\n", 0},
+		{"and with a value that is not a boolean",
+			`x = 1 and True`, "", ErrTypeMismatch},
+		{"or with a right operand that is not a boolean",
+			`x = False or 1`, "", ErrTypeMismatch},
+		{"power is right associative and binds tighter than a sign",
+			`println(2^3^2, " ", -2^2, " ", 2^-1, " ", (-2)^2)`, "512 -4 0.5 4\n", 0},
+		{"integer power",
+			`println(2^62, " ", 2^10, " ", 0^0, " ", (-2)^63)`, "4611686018427387904 1024 1 -9223372036854775808\n", 0},
+		{"integer power overflow",
+			`println(2^63, " ", 2^64)`, "9.223372036854776e+18 1.8446744073709552e+19\n", 0},
+		{"comparisons",
+			`println(1 < 1.5, " ", 2 == 2.0, " ", "abc" < "abd", " ", "a" == 1, " ", True != False)`,
+			"True True True False True\n", 0},
+		{"ordering values of different types",
+			`x = 1 < "a"`, "", ErrTypeMismatch},
+		{"ordering booleans",
+			`x = True < False`, "", ErrTypeMismatch},
+		{"ordering lists",
+			`x = {1} <= {2}`, "", ErrTypeMismatch},
+		{"elseif chain",
+			`for n in {95, 85, 40} do if n >= 90 then print("A") elseif n >= 80 then print("B") elif n >= 70 then print("C") else print("F") end end;
+			 if False then print("x") elseif False then print("y") end`, "ABF", 0},
+		{"switch with a jump table",
+			`for i = 0 to 5 do switch i case 0: print("a") case 1: print("b") case 2, 3: print("c") case 4: print("d") else print("-") end end`,
+			"abccd-", 0},
+		{"switch with ranges and strings",
+			`for c in "a7?" do switch c case "a", "e": print("vowel ") case "0".."9": print("digit ") else print("other") end end`,
+			"vowel digit other", 0},
+		{"closures share the enclosing local",
+			`function makeCounter() count = 0; return function() count = count + 1; return count end end;
+			 next = makeCounter(); next(); println(next())`, "2\n", 0},
+		{"functions are values",
+			`function apply(f, x) return f(x) end; fs = {function(x) return x + 1 end}; triple = function(x) return x * 3 end; println(apply(fs[0], 1), " ", apply(triple, 2))`,
+			"2 6\n", 0},
+		{"closure over a ref parameter outlives the frame",
+			`function f(ref a) return function() a = 42 end end;
+			 function g() x = 1; return f(x) end;
+			 h = g();
+			 function other(p) h(); return p end;
+			 println(other(7))`, "7\n", 0},
+		{"ref parameter called through a local variable",
+			`function outer() function h(ref a) a = 1 end; k = h; x = 0; k(x); return x end;
+			 println(outer())`, "", ErrRuntime},
+		{"ref parameter called through a global variable",
+			`function inc(ref a) a = a + 1 end; g = inc; a = 1; g(a)`, "", ErrRuntime},
+		{"arity of a function value",
+			`f = function(a) return a end; f(1, 2)`, "", ErrRuntime},
+		{"calling a value that is not a function",
+			`x = 1; x(2)`, "", ErrTypeMismatch},
+		{"locals, globals and nested functions",
+			`total = 1; x = 5;
+			 function add(n) global total; total = total + n; x = 0; return x end;
+			 function outer() function even(n) if n == 0 then return True end; return odd(n - 1) end;
+			 function odd(n) if n == 0 then return False end; return even(n - 1) end; return even(4) end;
+			 add(2); println(total, " ", x, " ", outer())`, "3 5 True\n", 0},
+		{"a module variable is read only without global",
+			`total = 1; function f() y = total + 1; return y end; println(f())`, "2\n", 0},
+		{"reassigned function is checked at run time",
+			`function f(a) return a end; f = function(a, b) return a + b end; println(f(1, 2))`, "3\n", 0},
+		{"defaults, named and variadic arguments",
+			`function f(a, b = a * 2, *rest) return a + b + len(rest) end;
+			 println(f(1), " ", f(1, b = 5), " ", f(1, 2, 3, 4))`, "3 6 5\n", 0},
+		{"an argument without value does not take the default",
+			`function nothing() end; function d() print("default "); return 1 end; function f(x = d()) return 0 end;
+			 println(f(nothing()))`, "0\n", 0},
+		{"a default cannot use the parameters after it",
+			`function f(a = b, b = 1) return a end; x = f()`, "", ErrUndefinedVariable},
+		{"multiple values",
+			`function f() return 1, 2 end; a, b = f(); f(); println(a, b)`, "12\n", 0},
+		{"multiple values returned again",
+			`function f() return 1, 2 end; function g() return f() end; a, b = g(); println(a + b)`, "3\n", 0},
+		{"multiple values assigned to a single variable",
+			`function f() return 1, 2 end; z = f()`, "", ErrTypeMismatch},
+		{"multiple values given as an argument",
+			`function f() return 1, 2 end; println(f())`, "", ErrTypeMismatch},
+		{"multiple values assigned to more variables",
+			`function f() return 1, 2 end; a, b, c = f()`, "", ErrDimensionMismatch},
+		{"list destructuring",
+			`function f() return {1, 2} end; z = f(); a, b = f(); println(z, a, b)`, "{1, 2}12\n", 0},
+		{"list of the wrong length",
+			`x, y = {1}`, "", ErrDimensionMismatch},
+		{"swap",
+			`a = 1; b = 2; a, b = b, a; println(a, b)`, "21\n", 0},
+		{"destructuring into elements",
+			`l = {0, 0}; m = {:}; l[1], m["k"] = 5, 6; println(l, m)`, "{0, 5}{\"k\": 6}\n", 0},
+	}
+	for _, test := range tests {
+		output, err := run(test.script)
+		if code := diagnosticCode(t, err); code != test.code {
+			t.Errorf("%s: expecting error %v, found %v", test.name, test.code, err)
+			continue
+		}
+		if output != test.output {
+			t.Errorf("%s: expecting output %q, found %q", test.name, test.output, output)
+		}
+	}
+}
+
+// TestSampleScripts runs the scripts of SampleScripts, some of them stop on
+// purpose with an error
+func TestSampleScripts(t *testing.T) {
+	tests := []struct {
+		file   string
+		code   ErrorCode
+		output string // checked when not empty
+	}{
+		{"arith.rh", 0, ""},
+		{"bool1.rh", ErrUndefinedVariable, ""},
+		{"closures.rh", 0, "{1, 4, 9, 16, 25, 36}\n21\n3 1\n15 2\n13\n42\n"},
+		{"comments.rh", 0, ""},
+		{"comments2.rh", ErrUnexpectedToken, ""},
+		{"elseif.rh", 0, "95 A\n85 B\n72 C\n40 F\ndone\n"},
+		{"for1.rh", 0, ""},
+		{"for2.rh", 0, strings.Repeat("Hello\n", 11)},
+		{"for3.rh", 0, ""},
+		{"forin.rh", 0, "sum of primes = 28\nR h o d u s \nAnn is 30\nBob is 25\n1 4 9 16 25 \n"},
+		{"func1.rh", 0, ""},
+		{"func2.rh", ErrUndefinedVariable, ""},
+		{"func3.rh", 0, "False\n"},
+		{"func4.rh", ErrStackOverflow, ""},
+		{"func5.rh", ErrUndefinedVariable, ""},
+		{"hamming.rh", 0, ""},
+		{"if1.rh", ErrUndefinedVariable, ""},
+		{"if2.rh", ErrUndefinedVariable, ""},
+		{"if3.rh", ErrUndefinedVariable, ""},
+		{"list1.rh", 0, ""},
+		{"multipleValues.rh", 0, "17 = 5*3 + 2\nintegral = 0.3333740234375, error estimate = 0.0001220703125\n2 1\nzyx\n55\n"},
+		{"parameters.rh", 0, "Hello, Ann!\nHi, Bob!\nHello, Eve?\nGood morning, Max.\n10 4 5\n1 10\n9 12\n"},
+		{"repeatString.rh", ErrUnexpectedToken, ""},
+		{"scope.rh", 0, ""},
+		{"switch.rh", 0, ""},
+		{"test1.rh", 0, ""},
+		{"test2.rh", 0, ""},
+		{"test3.rh", 0, ""},
+		{"test4.rh", 0, ""},
+		{"test5.rh", 0, ""},
+		{"test6.rh", 0, "The number is odd\n"},
+		{"while1.rh", ErrUndefinedVariable, ""},
+		{"while2.rh", ErrUndefinedVariable, ""},
+		{"x1.rh", 0, ""},
+	}
+	for _, test := range tests {
+		in := NewInterpreter()
+		var out bytes.Buffer
+		in.SetStdout(&out)
+		in.SetStderr(ioutil.Discard)
+		err := in.EvalFile("../SampleScripts/" + test.file)
+		if code := diagnosticCode(t, err); code != test.code {
+			t.Errorf("%s: expecting error %v, found %v", test.file, test.code, err)
+			continue
+		}
+		if test.output != "" && out.String() != test.output {
+			t.Errorf("%s: expecting output %q, found %q", test.file, test.output, out.String())
+		}
+	}
+}
+
+func TestInterpreter(t *testing.T) {
+	in := NewInterpreter()
+	var out, errors bytes.Buffer
+	in.SetStdout(&out)
+	in.SetStderr(&errors)
+	if err := in.SetGlobal("rate", 0.04); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.SetGlobal("names", []interface{}{"Ann", 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.SetGlobal("channel", make(chan int)); err == nil {
+		t.Errorf("SetGlobal accepts a channel")
+	}
+	steps := []struct {
+		script string
+		code   ErrorCode
+	}{
+		{`total = 500 + 500*rate`, 0},
+		{`function twice(x) return 2*x end`, 0},
+		{`doubled = twice(total); println(names[0])`, 0}, // globals and functions persist
+		{`println(missing)`, ErrUndefinedVariable},
+		{`x = `, ErrExpectingFactor},
+	}
+	for _, step := range steps {
+		if code := diagnosticCode(t, in.EvalString(step.script)); code != step.code {
+			t.Errorf("%s: expecting error %v", step.script, step.code)
+		}
+	}
+	for name, expected := range map[string]interface{}{"total": 520.0, "doubled": 1040.0, "names": []interface{}{"Ann", 2}} {
+		value, err := in.GetGlobal(name)
+		if err != nil || fmt.Sprint(value) != fmt.Sprint(expected) {
+			t.Errorf("GetGlobal(%s) = %v, %v, expecting %v", name, value, err, expected)
+		}
+	}
+	if _, err := in.GetGlobal("missing"); diagnosticCode(t, err) != ErrUndefinedVariable {
+		t.Errorf("GetGlobal(missing) returns %v", err)
+	}
+	if out.String() != "Ann\n" || strings.Count(errors.String(), "\n") != 2 {
+		t.Errorf("unexpected output %q and diagnostics %q", out.String(), errors.String())
+	}
+	if err := in.EvalString(`cycle = {1}; cycle[0] = cycle`); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := in.GetGlobal("cycle"); err != nil || value.([]interface{})[0].([]interface{})[0] == nil {
+		t.Errorf("GetGlobal(cycle) does not return a list that contains itself: %v", err)
+	}
+	in.SetMaxCallDepth(10)
+	if err := in.EvalString(`function f(n) return f(n + 1) end; f(0)`); diagnosticCode(t, err) != ErrStackOverflow {
+		t.Errorf("expecting a stack overflow, found %v", err)
+	}
+}
+
+type celsius float64
+
+func TestRegisterFunction(t *testing.T) {
+	in := NewInterpreter()
+	var out bytes.Buffer
+	in.SetStdout(&out)
+	in.SetStderr(ioutil.Discard)
+	for name, function := range map[string]interface{}{
+		"i64":     func(x int64) int64 { return x * 2 },
+		"u8":      func(x uint8) uint8 { return x + 1 },
+		"celsius": func(x float32) celsius { return celsius(x) },
+		"dynamic": func() interface{} { return []int{1} },
+		"boom":    func(x int) int { return 10 / x },
+	} {
+		if err := in.RegisterFunction(name, function); err != nil {
+			t.Errorf("RegisterFunction(%s): %v", name, err)
+		}
+	}
+	for name, function := range map[string]interface{}{
+		"sliceResult":    func() []int { return nil },
+		"sliceParameter": func(x []int) int { return 0 },
+		"errorParameter": func(err error) int { return 0 },
+		"notFunction":    42,
+	} {
+		if err := in.RegisterFunction(name, function); err == nil {
+			t.Errorf("RegisterFunction(%s) accepts an unsupported signature", name)
+		}
+	}
+	if err := in.EvalString(`println(i64(21), " ", u8(4), " ", celsius(2))`); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "42 5 2.0\n" {
+		t.Errorf("expecting %q, found %q", "42 5 2.0\n", out.String())
+	}
+	if err := in.EvalString(`u8(300)`); err == nil {
+		t.Errorf("u8(300) does not report the overflow")
+	}
+	err := in.EvalString(`dynamic()`)
+	if err == nil || strings.Count(err.Error(), "error E") != 1 {
+		t.Errorf("dynamic() reports %v", err)
+	}
+	err = in.EvalString(`boom(0)`)
+	if diagnosticCode(t, err) != ErrRuntime || !strings.Contains(err.Error(), "'boom'") {
+		t.Errorf("boom(0) reports %v", err)
+	}
+	out.Reset()
+	if err := in.EvalString(`println(boom(5))`); err != nil || out.String() != "2\n" {
+		t.Errorf("boom(5) after a panic: %q, %v", out.String(), err)
+	}
+}